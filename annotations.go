@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+)
+
+const (
+	// maxAnnotationSize is the maximum size of an annotation body accepted by Buildkite, see
+	// https://buildkite.com/docs/agent/v3/cli-annotate. Because we always annotate with --append,
+	// this is a limit on everything posted under a given context.
+	maxAnnotationSize = 1024 * 1024
+
+	// maxAnnotationSectionSize is the maximum size of a single output (stdout, stderr, ...) inlined
+	// in an annotation. Anything longer is truncated and uploaded in full as an artifact instead.
+	maxAnnotationSectionSize = 64 * 1024
+)
+
+// annotationOverflowNotice is appended, once, to an annotation context whose budget ran out, linking to the
+// artifact holding the entries which didn't fit.
+const annotationOverflowNotice = "\n> :warning: This annotation reached the maximum size allowed by Buildkite, further entries were omitted. See them in the [%s](artifact://%s) artifact.\n"
+
+// annotationOverflowRoom is kept in each context for the overflow notice, whose size depends on the path of the
+// artifact it links to.
+const annotationOverflowRoom = 4 * 1024
+
+// annotationBudget keeps track of how many bytes were posted to each annotation context, so we never
+// go over the size limit enforced by Buildkite, which would otherwise make buildkite-agent annotate fail.
+type annotationBudget struct {
+	limit int
+	used  map[string]int
+	// omitted holds the entries which didn't fit, and styles the style of their annotation, by context.
+	omitted map[string]*bytes.Buffer
+	styles  map[string]string
+	// contexts are the contexts with omitted entries, in the order their budget ran out.
+	contexts []string
+}
+
+func newAnnotationBudget(limit int) *annotationBudget {
+	return &annotationBudget{
+		// Keep room for the overflow notice, so it can always be posted.
+		limit:   limit - annotationOverflowRoom,
+		used:    map[string]int{},
+		omitted: map[string]*bytes.Buffer{},
+		styles:  map[string]string{},
+	}
+}
+
+// reserve records that n bytes are about to be posted in the given context, returning false if
+// that would exceed the limit.
+func (b *annotationBudget) reserve(annotationContext string, n int) bool {
+	if b.omitted[annotationContext] != nil || b.used[annotationContext]+n > b.limit {
+		return false
+	}
+	b.used[annotationContext] += n
+	return true
+}
+
+// omit records an entry which didn't fit in the given context. Once an entry didn't fit, the following ones of
+// the context are omitted too, so they are kept in order.
+func (b *annotationBudget) omit(style string, annotationContext string, markdown []byte) {
+	buf, ok := b.omitted[annotationContext]
+	if !ok {
+		buf = &bytes.Buffer{}
+		b.omitted[annotationContext] = buf
+		b.styles[annotationContext] = style
+		b.contexts = append(b.contexts, annotationContext)
+	}
+	buf.Write(markdown)
+}
+
+// annotate posts the markdown to the given annotation context, as long as it fits in the budget
+// of that context. Entries which don't fit are kept for annotateOverflow. Entries are appended in the order
+// annotate is called, so it's only called once the work done concurrently is over.
+func (p *BuildkitePlugin) annotate(ctx context.Context, style string, annotationContext string, markdown []byte) error {
+	if p.annotationBudget.reserve(annotationContext, len(markdown)) {
+		return p.agent.Annotate(ctx, style, annotationContext, markdown)
+	}
+	p.annotationBudget.omit(style, annotationContext, markdown)
+	return nil
+}
+
+// annotateOverflow uploads the entries of each annotation context which didn't fit as an artifact, and appends
+// a notice linking to it to the context. It's called once everything has been annotated.
+func (p *BuildkitePlugin) annotateOverflow(ctx context.Context) error {
+	var errs []error
+	for _, annotationContext := range p.annotationBudget.contexts {
+		name := annotationContext + ".md"
+		artifactPath, err := p.uploadOverflow(ctx, path.Join("annotations", name), p.annotationBudget.omitted[annotationContext].Bytes())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to upload the omitted %s annotations: %w", annotationContext, err))
+			continue
+		}
+		notice := fmt.Sprintf(annotationOverflowNotice, name, artifactPath)
+		if err := p.agent.Annotate(ctx, p.annotationBudget.styles[annotationContext], annotationContext, []byte(notice)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return newMultiError(errs...)
+}
+
+// truncateSection shortens b to about limit bytes, keeping its head and its tail as the beginning of
+// an output usually tells what was running and the end why it failed. Cuts are made on line breaks
+// when possible. It returns b untouched if it's short enough.
+func truncateSection(b []byte, limit int) ([]byte, bool) {
+	if len(b) <= limit {
+		return b, false
+	}
+	half := limit / 2
+	head := b[:half]
+	if i := bytes.LastIndexByte(head, '\n'); i > 0 {
+		head = head[:i+1]
+	}
+	tail := b[len(b)-half:]
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 && i < len(tail)-1 {
+		tail = tail[i+1:]
+	}
+
+	var out bytes.Buffer
+	out.Write(head)
+	if len(head) > 0 && head[len(head)-1] != '\n' {
+		out.WriteByte('\n')
+	}
+	fmt.Fprintf(&out, "[... %d bytes truncated ...]\n", len(b)-len(head)-len(tail))
+	out.Write(tail)
+	return out.Bytes(), true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAnnotateOverflow(t *testing.T) {
+	agent := newRecordingAgent()
+	p := newTestPlugin(t, agent)
+	p.annotationBudget = newAnnotationBudget(annotationOverflowRoom + 100)
+
+	ctx := context.Background()
+	entries := []string{strings.Repeat("a", 60) + "\n", strings.Repeat("b", 60) + "\n", "c\n"}
+	for _, m := range entries {
+		if err := p.annotate(ctx, "error", "failed_actions", []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.annotate(ctx, "warning", "flaky_tests", []byte("flaky\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.annotateOverflow(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry which fits after one didn't is omitted as well, to keep the entries in order.
+	b, ok := agent.Artifact("annotations/failed_actions.md")
+	if want := entries[1] + entries[2]; !ok || string(b) != want {
+		t.Errorf("annotations/failed_actions.md = %q, want %q", b, want)
+	}
+	var got []string
+	for _, a := range agent.Annotations() {
+		got = append(got, a.Context+": "+a.Markdown)
+	}
+	want := []string{
+		"failed_actions: " + entries[0],
+		"flaky_tests: flaky\n",
+		"failed_actions: \n> :warning: This annotation reached the maximum size allowed by Buildkite, further entries were omitted. See them in the [failed_actions.md](artifact://annotations/failed_actions.md) artifact.\n",
+	}
+	if strings.Join(got, "") != strings.Join(want, "") {
+		t.Errorf("annotations =\n%s\nwant:\n%s", strings.Join(got, ""), strings.Join(want, ""))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// artifactsDir returns the scratch directory of this invocation, creating it if needed. Downloaded outputs and
+// files to upload are all written there, under paths derived from the labels they belong to, which are also the
+// paths of the uploaded artifacts.
+func (p *BuildkitePlugin) artifactsDir() (string, error) {
+	if p.scratchDir != "" {
+		return p.scratchDir, nil
+	}
+	// Outside of the workspace by default, so it never ends up in the view Bazel has of the repository.
+	parent := p.artifactsParentDir
+	if parent != "" {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return "", err
+		}
+	}
+	dir, err := os.MkdirTemp(parent, "bk_artifacts_")
+	if err != nil {
+		return "", err
+	}
+	p.scratchDir = dir
+	if p.downloadCacheDir == "" {
+		// Outputs are then only cached for the duration of this invocation, alongside the artifacts.
+		p.outputClient.SetCacheDir(filepath.Join(dir, ".cas"))
+	}
+	return dir, nil
+}
+
+// cleanupArtifacts removes the scratch directory, once everything has been uploaded.
+func (p *BuildkitePlugin) cleanupArtifacts() {
+	if p.scratchDir == "" {
+		return
+	}
+	if err := os.RemoveAll(p.scratchDir); err != nil {
+		fmt.Printf("failed to remove %s: %s\n", p.scratchDir, err)
+	}
+	p.scratchDir = ""
+	p.outputClient.SetCacheDir(p.downloadCacheDir)
+}
+
+// defaultDownloadCacheMaxAge is how long outputs can go unused in the download cache before being removed from
+// it, unless configured otherwise.
+const defaultDownloadCacheMaxAge = 7 * 24 * time.Hour
+
+// pruneDownloadCache removes the outputs of the download cache that went unused for too long, as it's kept
+// across invocations and would otherwise only grow.
+func (p *BuildkitePlugin) pruneDownloadCache() {
+	if p.downloadCacheDir == "" || p.downloadCacheMaxAge <= 0 {
+		return
+	}
+	if _, err := p.outputClient.PruneCache(p.downloadCacheMaxAge); err != nil {
+		fmt.Printf("failed to prune %s: %s\n", p.downloadCacheDir, err)
+	}
+}
+
+var unsafeArtifactChars = regexp.MustCompile(`[^a-zA-Z0-9._~+=-]+`)
+
+// labelPath turns a label into a relative path, e.g. "//foo/bar:baz_test" into "foo/bar/baz_test" and
+// "@repo//foo:bar" into "repo/foo/bar".
+func labelPath(label string) string {
+	l := strings.TrimLeft(label, "@")
+	l = strings.Replace(l, "//", "/", 1)
+	l = strings.ReplaceAll(l, ":", "/")
+	var parts []string
+	for _, part := range strings.Split(l, "/") {
+		part = unsafeArtifactChars.ReplaceAllString(part, "_")
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return path.Join(parts...)
+}
+
+// artifactPath returns the relative path of a test output, mirroring the layout of bazel-testlogs.
+func (tr *testResultInfo) artifactPath(name string) string {
+	parts := []string{labelPath(tr.label)}
+	// Without a summary, as when the build was interrupted, the counts are unknown but the results of different
+	// shards and runs must not share paths.
+	if tr.summary == nil {
+		if tr.shard > 0 {
+			parts = append(parts, fmt.Sprintf("shard_%d", tr.shard))
+		}
+		if tr.run > 0 {
+			parts = append(parts, fmt.Sprintf("run_%d", tr.run))
+		}
+	}
+	if n := tr.summary.GetShardCount(); n > 1 {
+		parts = append(parts, fmt.Sprintf("shard_%d_of_%d", tr.shard, n))
+	}
+	if n := tr.summary.GetRunCount(); n > 1 {
+		parts = append(parts, fmt.Sprintf("run_%d_of_%d", tr.run, n))
+	}
+	if tr.attempt > 1 || tr.summary.GetAttemptCount() > 1 {
+		parts = append(parts, fmt.Sprintf("attempt_%d", tr.attempt))
+	}
+	return path.Join(append(parts, name)...)
+}
+
+// artifactPath returns the path of the artifact named name for this action. Several actions of a same target
+// can fail, so the path includes the position of the action among them.
+func (fa *failedAction) artifactPath(name string) string {
+	dir := fmt.Sprintf("action_%d", fa.index)
+	if fa.mnemonic != "" {
+		dir += "_" + unsafeArtifactChars.ReplaceAllString(fa.mnemonic, "_")
+	}
+	return path.Join(labelPath(fa.label), dir, name)
+}
+
+// fetchOutput returns a local path for the output at uri. Remote outputs are downloaded in the scratch
+// directory, at relPath.
+func (p *BuildkitePlugin) fetchOutput(ctx context.Context, uri string, relPath string) (string, error) {
+	dir, err := p.artifactsDir()
+	if err != nil {
+		return "", err
+	}
+	return p.outputClient.GetFilePath(ctx, uri, filepath.Join(dir, filepath.FromSlash(relPath)))
+}
+
+// uploadArtifact uploads the file at localPath as an artifact whose path is relPath, which is returned so it
+// can be linked to. Files that are not in the scratch directory yet are copied there first.
+func (p *BuildkitePlugin) uploadArtifact(ctx context.Context, localPath string, relPath string) (string, error) {
+	dir, err := p.artifactsDir()
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, filepath.FromSlash(relPath))
+	if filepath.Clean(localPath) != dest {
+		if err := copyFile(localPath, dest); err != nil {
+			return "", err
+		}
+	}
+	if err := p.agent.UploadArtifacts(ctx, dir, relPath); err != nil {
+		return "", err
+	}
+	return relPath, nil
+}
+
+// uploadOverflow writes the full content of an output that got truncated in an annotation to disk and
+// uploads it as an artifact at relPath, so the annotation can link to it.
+func (p *BuildkitePlugin) uploadOverflow(ctx context.Context, relPath string, data []byte) (string, error) {
+	dir, err := p.artifactsDir()
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(dest, data, 0644); err != nil {
+		return "", err
+	}
+	return p.uploadArtifact(ctx, dest, relPath)
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,243 @@
+// Package bytestreamtest provides an in-memory implementation of the ByteStream API, to test the clients of remote
+// caches without a remote cache.
+package bytestreamtest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/sourcegraph/aspect-cli-plugin-buildkite/bazel/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkSize is the size of the chunks resources are read in. It's small, so clients are tested against reads
+// spanning several messages.
+const chunkSize = 64 * 1024
+
+// Server is a ByteStream server holding its resources in memory, listening on a local port.
+type Server struct {
+	bytestream.UnimplementedByteStreamServer
+
+	listener net.Listener
+	server   *grpc.Server
+
+	mu sync.Mutex
+	// resources are the resources whose write is complete, by resource name.
+	resources map[string][]byte
+	// pending are the resources being written, by resource name.
+	pending map[string][]byte
+	reads   int
+	// failWriteAfter is how many bytes the next write commits before failing, -1 if it doesn't fail.
+	failWriteAfter int64
+	// writeOffsets are the offsets the writes started at.
+	writeOffsets []int64
+	// written is how many bytes the writes sent in total.
+	written int64
+}
+
+// NewServer starts a server on a local port. It must be closed once done with.
+func NewServer() (*Server, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener:       lis,
+		server:         grpc.NewServer(),
+		resources:      map[string][]byte{},
+		pending:        map[string][]byte{},
+		failWriteAfter: -1,
+	}
+	bytestream.RegisterByteStreamServer(s.server, s)
+	go s.server.Serve(lis)
+	return s, nil
+}
+
+// Addr returns the host and port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// URI returns the bytestream:// URI of the given resource on this server.
+func (s *Server) URI(resourceName string) string {
+	return fmt.Sprintf("bytestream://%s/%s", s.Addr(), strings.TrimPrefix(resourceName, "/"))
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.server.Stop()
+}
+
+// Put stores a resource, as if it had been written.
+func (s *Server) Put(resourceName string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resources[normalize(resourceName)] = data
+}
+
+// PutBlob stores data in the content-addressable storage, as Bazel would when uploading an output, and returns
+// the URI to read it from.
+func (s *Server) PutBlob(data []byte) string {
+	resourceName := BlobResourceName(data)
+	s.Put(resourceName, data)
+	return s.URI(resourceName)
+}
+
+// Get returns the content of a resource whose write is complete.
+func (s *Server) Get(resourceName string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.resources[normalize(resourceName)]
+	return data, ok
+}
+
+// Reads returns how many reads the server has served.
+func (s *Server) Reads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+// FailWriteAfter makes the next write fail with codes.Unavailable, once it has committed at least n bytes, leaving
+// what it committed to be resumed.
+func (s *Server) FailWriteAfter(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failWriteAfter = n
+}
+
+// WriteOffsets returns the offsets each write started at, in the order they were made.
+func (s *Server) WriteOffsets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.writeOffsets...)
+}
+
+// Written returns how many bytes the writes sent in total.
+func (s *Server) Written() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.written
+}
+
+// BlobResourceName returns the name data is read under from a content-addressable storage using SHA-256.
+func BlobResourceName(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("blobs/%s/%d", hex.EncodeToString(sum[:]), len(data))
+}
+
+func normalize(resourceName string) string {
+	return strings.TrimPrefix(resourceName, "/")
+}
+
+// Read implements bytestream.ByteStreamServer.
+func (s *Server) Read(req *bytestream.ReadRequest, stream bytestream.ByteStream_ReadServer) error {
+	s.mu.Lock()
+	data, ok := s.resources[normalize(req.GetResourceName())]
+	s.reads++
+	s.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "resource %q not found", req.GetResourceName())
+	}
+
+	offset, limit := req.GetReadOffset(), req.GetReadLimit()
+	if offset < 0 || offset > int64(len(data)) {
+		return status.Errorf(codes.OutOfRange, "offset %d is out of range for %d bytes", offset, len(data))
+	}
+	if limit < 0 {
+		return status.Errorf(codes.InvalidArgument, "negative read limit %d", limit)
+	}
+	end := int64(len(data))
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	for offset < end {
+		n := end - offset
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if err := stream.Send(&bytestream.ReadResponse{Data: data[offset : offset+n]}); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// Write implements bytestream.ByteStreamServer. Resources written to the upload form of the content-addressable
+// storage, "[{instance_name}/]uploads/{uuid}/blobs/{hash}/{size}", are then read from
+// "[{instance_name}/]blobs/{hash}/{size}".
+func (s *Server) Write(stream bytestream.ByteStream_WriteServer) error {
+	var resourceName string
+	first := true
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "the stream ended before the write was finished")
+		}
+		if err != nil {
+			return err
+		}
+		if resourceName == "" {
+			resourceName = normalize(req.GetResourceName())
+			if resourceName == "" {
+				return status.Error(codes.InvalidArgument, "missing resource name")
+			}
+		}
+
+		s.mu.Lock()
+		if first {
+			first = false
+			s.writeOffsets = append(s.writeOffsets, req.GetWriteOffset())
+		}
+		s.written += int64(len(req.GetData()))
+		data := s.pending[resourceName]
+		if req.GetWriteOffset() != int64(len(data)) {
+			s.mu.Unlock()
+			return status.Errorf(codes.InvalidArgument, "write at offset %d, but %d bytes are committed", req.GetWriteOffset(), len(data))
+		}
+		data = append(data, req.GetData()...)
+		s.pending[resourceName] = data
+		if s.failWriteAfter >= 0 && int64(len(data)) >= s.failWriteAfter && !req.GetFinishWrite() {
+			s.failWriteAfter = -1
+			s.mu.Unlock()
+			return status.Errorf(codes.Unavailable, "write interrupted after %d bytes", len(data))
+		}
+		if req.GetFinishWrite() {
+			delete(s.pending, resourceName)
+			s.resources[resourceName] = data
+			if i := strings.Index(resourceName, "uploads/"); i >= 0 {
+				if j := strings.Index(resourceName[i:], "/blobs/"); j >= 0 {
+					s.resources[resourceName[:i]+resourceName[i+j+1:]] = data
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		if req.GetFinishWrite() {
+			return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(len(data))})
+		}
+	}
+}
+
+// QueryWriteStatus implements bytestream.ByteStreamServer.
+func (s *Server) QueryWriteStatus(_ context.Context, req *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := normalize(req.GetResourceName())
+	if data, ok := s.resources[name]; ok {
+		return &bytestream.QueryWriteStatusResponse{CommittedSize: int64(len(data)), Complete: true}, nil
+	}
+	if data, ok := s.pending[name]; ok {
+		return &bytestream.QueryWriteStatusResponse{CommittedSize: int64(len(data))}, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "resource %q not found", req.GetResourceName())
+}
@@ -12,11 +12,15 @@ package bytestream
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -79,14 +83,7 @@ func (r *Reader) Read(p []byte) (int, error) {
 		}
 
 		// back off
-		if backoffDelay < backoffBase {
-			backoffDelay = backoffBase
-		} else {
-			backoffDelay = time.Duration(float64(backoffDelay) * 1.3 * (1 - 0.4*rand.Float64()))
-		}
-		if backoffDelay > backoffMax {
-			backoffDelay = backoffMax
-		}
+		backoffDelay = nextBackoff(backoffDelay)
 		t := time.NewTimer(backoffDelay)
 		select {
 		case <-t.C:
@@ -122,10 +119,17 @@ func (c *Client) NewReader(ctx context.Context, resourceName string) (*Reader, e
 
 // NewReaderAt creates a new Reader to read a resource from the given offset.
 func (c *Client) NewReaderAt(ctx context.Context, resourceName string, offset int64) (*Reader, error) {
+	return c.NewReaderRange(ctx, resourceName, offset, 0)
+}
+
+// NewReaderRange creates a new Reader to read at most limit bytes of a resource, from the given offset.
+// A limit of 0 reads until the end of the resource.
+func (c *Client) NewReaderRange(ctx context.Context, resourceName string, offset int64, limit int64) (*Reader, error) {
 	// readClient is set up for Read(). ReadAt() will copy needed fields into its reentrantReader.
 	readClient, err := c.client.Read(ctx, &ReadRequest{
 		ResourceName: resourceName,
 		ReadOffset:   offset,
+		ReadLimit:    limit,
 	}, c.options...)
 	if err != nil {
 		return nil, err
@@ -145,7 +149,14 @@ type Writer struct {
 	writeClient  ByteStream_WriteClient
 	resourceName string
 	offset       int64
-	err          error
+	// committed is how many bytes of the resource the server already had when the Writer was created. They are
+	// skipped rather than sent again.
+	committed int64
+	// complete is true if the server already had the whole resource, in which case nothing is sent.
+	complete bool
+	// started is true once the first WriteRequest has been sent.
+	started bool
+	err     error
 }
 
 // ResourceName gets the resource name this Writer is writing.
@@ -158,8 +169,20 @@ func (w *Writer) Write(p []byte) (int, error) {
 	if w.err != nil {
 		return 0, w.err
 	}
+	if w.complete {
+		w.offset += int64(len(p))
+		return len(p), nil
+	}
 
 	n := 0
+	if w.offset < w.committed {
+		skip := w.committed - w.offset
+		if skip > int64(len(p)) {
+			skip = int64(len(p))
+		}
+		n = int(skip)
+		w.offset += skip
+	}
 	for n < len(p) {
 		bufSize := len(p) - n
 		if bufSize > MaxBufSize {
@@ -171,14 +194,21 @@ func (w *Writer) Write(p []byte) (int, error) {
 			Data:        p[n : n+bufSize],
 		}
 		// Bytestream only requires the resourceName to be sent in the first WriteRequest.
-		if w.offset == 0 {
+		if !w.started {
 			r.ResourceName = w.resourceName
 		}
 		err := w.writeClient.Send(&r)
+		if err == io.EOF {
+			// The stream was aborted, the actual error is returned when receiving.
+			if _, recvErr := w.writeClient.CloseAndRecv(); recvErr != nil {
+				err = recvErr
+			}
+		}
 		if err != nil {
 			w.err = err
 			return n, err
 		}
+		w.started = true
 		w.offset += int64(bufSize)
 		n += bufSize
 	}
@@ -187,20 +217,27 @@ func (w *Writer) Write(p []byte) (int, error) {
 
 // Close implements io.Closer. It is the caller's responsibility to call Close() when writing is done.
 func (w *Writer) Close() error {
+	if w.complete {
+		return nil
+	}
+	if w.offset < w.committed {
+		w.err = fmt.Errorf("only %d bytes written, but the server already has %d", w.offset, w.committed)
+		return w.err
+	}
 	err := w.writeClient.Send(&WriteRequest{
 		ResourceName: w.resourceName,
 		WriteOffset:  w.offset,
 		FinishWrite:  true,
 		Data:         nil,
 	})
-	if err != nil {
+	if err != nil && err != io.EOF {
 		w.err = err
-		return fmt.Errorf("Send(WriteRequest< FinishWrite >) failed: %v", err)
+		return fmt.Errorf("Send(WriteRequest< FinishWrite >) failed: %w", err)
 	}
 	resp, err := w.writeClient.CloseAndRecv()
 	if err != nil {
 		w.err = err
-		return fmt.Errorf("CloseAndRecv: %v", err)
+		return fmt.Errorf("CloseAndRecv: %w", err)
 	}
 	if resp == nil {
 		err = fmt.Errorf("expected a response on close, got %v", resp)
@@ -218,7 +255,7 @@ func (w *Writer) Close() error {
 //
 // It is the caller's responsibility to call Close when writing is done.
 //
-// TODO: There is currently no way to resume a write. Maybe NewWriter should begin with a call to QueryWriteStatus.
+// Use NewResumableWriter to resume a write that was interrupted.
 func (c *Client) NewWriter(ctx context.Context, resourceName string) (*Writer, error) {
 	wc, err := c.client.Write(ctx, c.options...)
 	if err != nil {
@@ -231,6 +268,113 @@ func (c *Client) NewWriter(ctx context.Context, resourceName string) (*Writer, e
 	}, nil
 }
 
+// NewResumableWriter creates a new Writer to write a resource whose write may have been interrupted before. It
+// queries how much of the resource the server has already committed, and skips that many bytes of what is then
+// written, so callers always write the resource from the start. Nothing is sent if the write is complete already.
+//
+// It is the caller's responsibility to call Close when writing is done.
+func (c *Client) NewResumableWriter(ctx context.Context, resourceName string) (*Writer, error) {
+	committed, complete, err := c.QueryWriteStatus(ctx, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	if complete {
+		return &Writer{
+			ctx:          ctx,
+			resourceName: resourceName,
+			complete:     true,
+		}, nil
+	}
+	w, err := c.NewWriter(ctx, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	w.committed = committed
+	return w, nil
+}
+
+// QueryWriteStatus returns how many bytes of a resource the server has committed, and whether its write is
+// complete. A resource that the server doesn't know about has no bytes committed.
+func (c *Client) QueryWriteStatus(ctx context.Context, resourceName string) (committed int64, complete bool, err error) {
+	resp, err := c.client.QueryWriteStatus(ctx, &QueryWriteStatusRequest{ResourceName: resourceName}, c.options...)
+	if status.Code(err) == codes.NotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return resp.GetCommittedSize(), resp.GetComplete(), nil
+}
+
+// WriteFrom writes a resource of the given size, read from r. When the write fails with a transient error, it
+// is resumed from what the server has committed, up to maxTries times.
+func (c *Client) WriteFrom(ctx context.Context, resourceName string, r io.ReaderAt, size int64) error {
+	var backoffDelay time.Duration
+	var err error
+	for tries := 0; tries < maxTries; tries++ {
+		if tries > 0 {
+			backoffDelay = nextBackoff(backoffDelay)
+			t := time.NewTimer(backoffDelay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		}
+		err = c.writeFrom(ctx, resourceName, r, size)
+		if err == nil || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) writeFrom(ctx context.Context, resourceName string, r io.ReaderAt, size int64) error {
+	// Cancel the stream if the write fails midway.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := c.NewResumableWriter(ctx, resourceName)
+	if err != nil {
+		return err
+	}
+	if w.complete {
+		return nil
+	}
+	// Only read what the server doesn't have yet.
+	w.offset = w.committed
+	if _, err := io.Copy(w, io.NewSectionReader(r, w.committed, size-w.committed)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// isTransient returns true if err is a gRPC error that can go away by retrying.
+func isTransient(err error) bool {
+	var s interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &s) {
+		return false
+	}
+	switch s.GRPCStatus().Code() {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// nextBackoff returns how long to wait before the next try, given how long was waited before the previous one.
+func nextBackoff(backoffDelay time.Duration) time.Duration {
+	if backoffDelay < backoffBase {
+		backoffDelay = backoffBase
+	} else {
+		backoffDelay = time.Duration(float64(backoffDelay) * 1.3 * (1 - 0.4*rand.Float64()))
+	}
+	if backoffDelay > backoffMax {
+		backoffDelay = backoffMax
+	}
+	return backoffDelay
+}
+
 // Close closes the connection to the API service. The user should invoke this when
 // the client is no longer required.
 func (c *Client) Close() {
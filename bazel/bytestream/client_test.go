@@ -0,0 +1,64 @@
+package bytestream_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sourcegraph/aspect-cli-plugin-buildkite/bazel/bytestream"
+	"github.com/sourcegraph/aspect-cli-plugin-buildkite/bazel/bytestream/bytestreamtest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func newTestClient(t *testing.T) (*bytestreamtest.Server, *bytestream.Client) {
+	t.Helper()
+	server, err := bytestreamtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	conn, err := grpc.Dial(server.Addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := bytestream.NewClient(conn)
+	t.Cleanup(c.Close)
+	return server, c
+}
+
+func TestWriteFromResumesInterruptedWrite(t *testing.T) {
+	server, c := newTestClient(t)
+	data := bytes.Repeat([]byte("0123456789"), bytestream.MaxBufSize/4)
+	name := "uploads/1/" + bytestreamtest.BlobResourceName(data)
+	// Fail once the first message is committed, the write is then to be resumed after it.
+	server.FailWriteAfter(bytestream.MaxBufSize)
+
+	if err := c.WriteFrom(context.Background(), name, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := server.Get(name); !ok || !bytes.Equal(got, data) {
+		t.Fatalf("server has %d bytes, want the %d written", len(got), len(data))
+	}
+	if got, want := fmt.Sprint(server.WriteOffsets()), fmt.Sprint([]int64{0, bytestream.MaxBufSize}); got != want {
+		t.Errorf("writes started at offsets %s, want %s", got, want)
+	}
+	if n := server.Written(); n != int64(len(data)) {
+		t.Errorf("sent %d bytes, want %d, committed bytes must not be sent again", n, len(data))
+	}
+}
+
+func TestWriteFromCompleteWrite(t *testing.T) {
+	server, c := newTestClient(t)
+	data := []byte("hello world")
+	name := "uploads/1/" + bytestreamtest.BlobResourceName(data)
+	server.Put(name, data)
+
+	if err := c.WriteFrom(context.Background(), name, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if offsets := server.WriteOffsets(); len(offsets) != 0 {
+		t.Errorf("wrote %d times a resource already complete, want none", len(offsets))
+	}
+}
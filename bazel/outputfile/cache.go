@@ -0,0 +1,213 @@
+package outputfile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Digest identifies a blob stored in a content-addressable storage, see
+// https://github.com/bazelbuild/remote-apis/blob/main/build/bazel/remote/execution/v2/remote_execution.proto.
+type Digest struct {
+	// Function is the lowercase name of the digest function, e.g. "sha256". It's empty when the resource
+	// name doesn't specify it, in which case it's inferred from the length of the hash.
+	Function string
+	Hash     string
+	Size     int64
+}
+
+// digestFunctions are the names of the digest functions that can appear in resource names.
+var digestFunctions = map[string]bool{
+	"sha256":     true,
+	"sha1":       true,
+	"md5":        true,
+	"sha384":     true,
+	"sha512":     true,
+	"blake3":     true,
+	"sha256tree": true,
+}
+
+// ParseDigest extracts the digest from a bytestream resource name, which has the form
+// "[{instance_name}/]blobs/[{digest_function}/]{hash}/{size}[/{anything}]".
+func ParseDigest(resourceName string) (Digest, bool) {
+	parts := strings.Split(strings.Trim(resourceName, "/"), "/")
+	for i, part := range parts {
+		if part != "blobs" {
+			continue
+		}
+		rest := parts[i+1:]
+		var d Digest
+		if len(rest) > 0 && digestFunctions[rest[0]] {
+			d.Function = rest[0]
+			rest = rest[1:]
+		}
+		if len(rest) < 2 || rest[0] == "" {
+			return Digest{}, false
+		}
+		size, err := strconv.ParseInt(rest[1], 10, 64)
+		if err != nil || size < 0 {
+			return Digest{}, false
+		}
+		d.Hash = strings.ToLower(rest[0])
+		d.Size = size
+		return d, true
+	}
+	return Digest{}, false
+}
+
+// SetCacheDir makes the client keep the blobs it fetches from bytestream URIs in dir, indexed by their digest,
+// so each of them is only downloaded once, no matter how many times or under which URI it's requested. The
+// cache can be shared by invocations running on the same machine. Caching is disabled when dir is empty.
+func (c *Client) SetCacheDir(dir string) {
+	c.cacheDir = dir
+}
+
+// cacheDigest returns the digest of the blob at u, if it can be cached. Blobs whose hash can't be verified
+// are not, as a corrupted one of the right size would otherwise be served from the cache for good.
+func (c *Client) cacheDigest(u *url.URL) (Digest, bool) {
+	if c.cacheDir == "" || u.Scheme != "bytestream" {
+		return Digest{}, false
+	}
+	d, ok := ParseDigest(u.Path)
+	if !ok || newDigestHash(d) == nil {
+		return Digest{}, false
+	}
+	return d, true
+}
+
+func (c *Client) cachePath(d Digest) string {
+	name := fmt.Sprintf("%s_%d", d.Hash, d.Size)
+	prefix := d.Hash
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	function := d.Function
+	if function == "" {
+		function = "default"
+	}
+	return filepath.Join(c.cacheDir, function, prefix, name)
+}
+
+// cachedBlob returns the path of the blob with the given digest in the cache, fetching it with r first if
+// it's not there yet.
+func (c *Client) cachedBlob(ctx context.Context, r Resolver, u *url.URL, d Digest) (string, error) {
+	path := c.cachePath(d)
+	unlock := c.lockBlob(path)
+	defer unlock()
+	if _, err := os.Stat(path); err == nil {
+		// Mark it as used, so it's not pruned while it's still needed, see PruneCache.
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+		return path, nil
+	}
+
+	rc, err := c.open(ctx, r, u)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// Write to a temporary file first, so a partially downloaded blob is never found in the cache.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// PruneCache removes the blobs of the cache that haven't been used for longer than maxAge, as well as the
+// leftovers of interrupted downloads, and returns how many files were removed. Nothing else evicts them, so
+// a cache kept across invocations grows without bounds unless it's pruned.
+func (c *Client) PruneCache(maxAge time.Duration) (int, error) {
+	if c.cacheDir == "" {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	err := filepath.WalkDir(c.cacheDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// lockBlob locks the blob at the given path in the cache, so it's only fetched once when it's requested
+// concurrently. It returns the function unlocking it.
+func (c *Client) lockBlob(path string) func() {
+	c.mu.Lock()
+	l, ok := c.blobLocks[path]
+	if !ok {
+		l = &sync.Mutex{}
+		c.blobLocks[path] = l
+	}
+	c.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// linkOrCopy makes the file at src available at dest, without copying it when possible.
+func linkOrCopy(src string, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	_ = os.Remove(dest)
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
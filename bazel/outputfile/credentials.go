@@ -0,0 +1,336 @@
+package outputfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Credentials configures how the client authenticates to the remote cache serving the outputs, with the same
+// semantics as the Bazel flags of the same names, see https://bazel.build/reference/command-line-reference.
+type Credentials struct {
+	// TLS forces connections to use TLS, even to hosts not listed in TLSHosts.
+	TLS bool
+	// TLSHosts are the hosts (with their port, if any) that are reached over TLS, i.e. the remote endpoints
+	// configured with the grpcs scheme.
+	TLSHosts []string
+	// TLSCertificate is the path to a PEM file of the certificate authority used to verify the server
+	// (--tls_certificate). Setting it implies TLS.
+	TLSCertificate string
+	// TLSClientCertificate and TLSClientKey are the paths to the PEM files of the client certificate and its key,
+	// used to authenticate to the server (--tls_client_certificate and --tls_client_key).
+	TLSClientCertificate string
+	TLSClientKey         string
+	// Endpoints are the URLs of the remote cache and executor (--remote_cache, --remote_executor), the grpcs
+	// scheme being implied when they have none.
+	Endpoints []string
+	// Headers are sent along the requests to the hosts of Endpoints (--remote_header, --remote_cache_header), so
+	// the tokens they usually hold don't leak to other hosts. They are only sent in plaintext to endpoints
+	// configured without TLS.
+	Headers map[string][]string
+	// CredentialHelpers provide headers for the hosts they apply to (--credential_helper).
+	CredentialHelpers []CredentialHelper
+}
+
+// CredentialHelper is a binary implementing the Bazel credential helper protocol, see
+// https://github.com/bazelbuild/proposals/blob/main/designs/2022-06-07-bazel-credential-helpers.md.
+type CredentialHelper struct {
+	// Scope is the host the helper applies to, which may start with a "*." wildcard. Applies to all hosts if empty.
+	Scope string
+	// Path is the path to the helper binary, where %workspace% stands for the workspace directory.
+	Path string
+}
+
+// ParseBazelFlags extracts the credentials from Bazel flags, as found in the command line reported
+// by the BEP OptionsParsed event. Flags are expected in their canonical --name=value form.
+func ParseBazelFlags(args []string) *Credentials {
+	creds := &Credentials{Headers: map[string][]string{}}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "tls_certificate":
+			creds.TLSCertificate = value
+		case "tls_client_certificate":
+			creds.TLSClientCertificate = value
+		case "tls_client_key":
+			creds.TLSClientKey = value
+		case "remote_header", "remote_cache_header":
+			if k, v, ok := strings.Cut(value, "="); ok {
+				creds.Headers[k] = append(creds.Headers[k], v)
+			}
+		case "credential_helper":
+			creds.CredentialHelpers = append(creds.CredentialHelpers, ParseCredentialHelper(value))
+		case "remote_cache", "remote_executor":
+			creds.AddEndpoint(value)
+		}
+	}
+	return creds
+}
+
+// AddEndpoint adds the URL of a remote endpoint, reached over TLS if its scheme is grpcs or https. Like Bazel,
+// it defaults to grpcs when no scheme is given.
+func (c *Credentials) AddEndpoint(value string) {
+	if value == "" {
+		return
+	}
+	if !strings.Contains(value, "://") {
+		value = "grpcs://" + value
+	}
+	c.Endpoints = append(c.Endpoints, value)
+	if u, err := url.Parse(value); err == nil && (u.Scheme == "grpcs" || u.Scheme == "https") {
+		c.TLSHosts = append(c.TLSHosts, u.Host)
+	}
+}
+
+// ParseCredentialHelper parses the value of a --credential_helper flag, "[scope=]path".
+func ParseCredentialHelper(value string) CredentialHelper {
+	if scope, path, ok := strings.Cut(value, "="); ok {
+		return CredentialHelper{Scope: scope, Path: path}
+	}
+	return CredentialHelper{Path: value}
+}
+
+// Merge overrides the credentials with the ones set in o.
+func (c *Credentials) Merge(o *Credentials) {
+	if o == nil {
+		return
+	}
+	c.TLS = c.TLS || o.TLS
+	c.TLSHosts = append(c.TLSHosts, o.TLSHosts...)
+	c.Endpoints = append(c.Endpoints, o.Endpoints...)
+	if o.TLSCertificate != "" {
+		c.TLSCertificate = o.TLSCertificate
+	}
+	if o.TLSClientCertificate != "" {
+		c.TLSClientCertificate = o.TLSClientCertificate
+	}
+	if o.TLSClientKey != "" {
+		c.TLSClientKey = o.TLSClientKey
+	}
+	if len(o.Headers) > 0 && c.Headers == nil {
+		c.Headers = map[string][]string{}
+	}
+	for k, v := range o.Headers {
+		c.Headers[k] = v
+	}
+	// Helpers are matched in order, make the overrides win.
+	c.CredentialHelpers = append(append([]CredentialHelper{}, o.CredentialHelpers...), c.CredentialHelpers...)
+}
+
+func (c *Credentials) useTLS(host string) bool {
+	if c.TLS || c.TLSCertificate != "" || c.TLSClientCertificate != "" {
+		return true
+	}
+	for _, h := range c.TLSHosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Credentials) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if c.TLSCertificate != "" {
+		pem, err := os.ReadFile(c.TLSCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSCertificate)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.TLSClientCertificate != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSClientCertificate, c.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// credentialHelper returns the helper applying to the given host, if any. Exact scopes take precedence over
+// wildcards, which take precedence over helpers without scope.
+func (c *Credentials) credentialHelper(host string) *CredentialHelper {
+	var wildcard, fallback *CredentialHelper
+	for i := range c.CredentialHelpers {
+		h := &c.CredentialHelpers[i]
+		switch {
+		case h.Scope == host:
+			return h
+		case strings.HasPrefix(h.Scope, "*.") && strings.HasSuffix(host, h.Scope[1:]) && wildcard == nil:
+			wildcard = h
+		case h.Scope == "" && fallback == nil:
+			fallback = h
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return fallback
+}
+
+// dialOptions returns the options to dial the given host with these credentials.
+func (c *Credentials) dialOptions(host string) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	secure := c.useTLS(host)
+	if secure {
+		cfg, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	if hc := c.headerCredentials("https", host, secure); hc != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(hc))
+	}
+	return opts, nil
+}
+
+// headerCredentials returns the source of the headers to send to the given host, or nil if there are none. The
+// scheme is the one of the URI given to credential helpers, and secure tells if the connection uses TLS.
+func (c *Credentials) headerCredentials(scheme string, host string, secure bool) *headerCredentials {
+	hostname := host
+	if u, err := url.Parse("//" + host); err == nil {
+		hostname = u.Hostname()
+	}
+	helper := c.credentialHelper(hostname)
+	var headers map[string][]string
+	if c.isEndpoint(host, hostname, secure) {
+		headers = c.Headers
+	}
+	if len(headers) == 0 && helper == nil {
+		return nil
+	}
+	return &headerCredentials{
+		headers: headers,
+		helper:  helper,
+		uri:     scheme + "://" + host,
+	}
+}
+
+// isEndpoint returns true if host, whose name is hostname, is the host of one of the endpoints, and the connection
+// is secure unless the endpoint was configured without TLS. Endpoints without a port match the host on any port.
+func (c *Credentials) isEndpoint(host string, hostname string, secure bool) bool {
+	for _, e := range c.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if u.Port() != "" && u.Host != host {
+			continue
+		}
+		if u.Port() == "" && u.Hostname() != hostname {
+			continue
+		}
+		if secure || u.Scheme == "http" || u.Scheme == "grpc" {
+			return true
+		}
+	}
+	return false
+}
+
+// headerCredentials attaches the configured headers, and the ones obtained from a credential helper, to
+// every RPC.
+type headerCredentials struct {
+	headers map[string][]string
+	helper  *CredentialHelper
+	uri     string
+
+	mu       sync.Mutex
+	fetched  map[string][]string
+	expireAt time.Time
+}
+
+func (h *headerCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	md := map[string]string{}
+	for k, v := range h.headers {
+		md[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	if h.helper != nil {
+		fetched, err := h.helperHeaders(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range fetched {
+			md[strings.ToLower(k)] = strings.Join(v, ",")
+		}
+	}
+	return md, nil
+}
+
+// RequireTransportSecurity returns false as, like Bazel, we let users send headers over plaintext
+// connections if that's what they configured.
+func (h *headerCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// helperHeaders runs the credential helper, caching its response until it expires.
+func (h *headerCredentials) helperHeaders(ctx context.Context) (map[string][]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.fetched != nil && (h.expireAt.IsZero() || time.Now().Before(h.expireAt)) {
+		return h.fetched, nil
+	}
+
+	path := h.helper.Path
+	if strings.Contains(path, "%workspace%") {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		path = strings.ReplaceAll(path, "%workspace%", wd)
+	}
+	req, err := json.Marshal(map[string]string{"uri": h.uri})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, path, "get")
+	cmd.Stdin = bytes.NewReader(req)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s failed: %w: %s", path, err, stderr.String())
+	}
+
+	var resp struct {
+		Expires string              `json:"expires"`
+		Headers map[string][]string `json:"headers"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("credential helper %s returned an invalid response: %w", path, err)
+	}
+	h.fetched = resp.Headers
+	if h.fetched == nil {
+		h.fetched = map[string][]string{}
+	}
+	h.expireAt = time.Time{}
+	if resp.Expires != "" {
+		if t, err := time.Parse(time.RFC3339, resp.Expires); err == nil {
+			h.expireAt = t
+		}
+	}
+	return h.fetched, nil
+}
@@ -0,0 +1,281 @@
+package outputfile
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBazelFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		want *Credentials
+		// tls lists the hosts expected to be reached over TLS, plain the ones which aren't.
+		tls, plain []string
+	}{
+		{
+			name:  "grpc",
+			args:  []string{"--remote_cache=grpc://cache.example.com:9092"},
+			want:  &Credentials{Endpoints: []string{"grpc://cache.example.com:9092"}, Headers: map[string][]string{}},
+			plain: []string{"cache.example.com:9092"},
+		},
+		{
+			name: "grpcs",
+			args: []string{"--remote_executor=grpcs://remote.example.com"},
+			want: &Credentials{
+				Endpoints: []string{"grpcs://remote.example.com"},
+				TLSHosts:  []string{"remote.example.com"},
+				Headers:   map[string][]string{},
+			},
+			tls:   []string{"remote.example.com"},
+			plain: []string{"other.example.com"},
+		},
+		{
+			name: "no scheme defaults to grpcs",
+			args: []string{"--remote_cache=cache.example.com:443"},
+			want: &Credentials{
+				Endpoints: []string{"grpcs://cache.example.com:443"},
+				TLSHosts:  []string{"cache.example.com:443"},
+				Headers:   map[string][]string{},
+			},
+			tls: []string{"cache.example.com:443"},
+		},
+		{
+			name: "repeated headers",
+			args: []string{
+				"--remote_header=x-api-key=a",
+				"--remote_header=x-api-key=b",
+				"--remote_cache_header=Authorization=Bearer c=d",
+				"--remote_header=invalid",
+			},
+			want: &Credentials{Headers: map[string][]string{"x-api-key": {"a", "b"}, "Authorization": {"Bearer c=d"}}},
+		},
+		{
+			name: "TLS files and helpers",
+			args: []string{
+				"--tls_certificate=ca.pem",
+				"--tls_client_certificate=client.pem",
+				"--tls_client_key=client.key",
+				"--credential_helper=*.example.com=/bin/helper",
+				"--credential_helper=%workspace%/tools/helper",
+				"--remote_download_minimal",
+			},
+			want: &Credentials{
+				TLSCertificate:       "ca.pem",
+				TLSClientCertificate: "client.pem",
+				TLSClientKey:         "client.key",
+				Headers:              map[string][]string{},
+				CredentialHelpers: []CredentialHelper{
+					{Scope: "*.example.com", Path: "/bin/helper"},
+					{Path: "%workspace%/tools/helper"},
+				},
+			},
+			tls: []string{"anything.example.com"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ParseBazelFlags(tc.args)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseBazelFlags() = %+v, want %+v", got, tc.want)
+			}
+			for _, host := range tc.tls {
+				if !got.useTLS(host) {
+					t.Errorf("useTLS(%q) = false, want true", host)
+				}
+			}
+			for _, host := range tc.plain {
+				if got.useTLS(host) {
+					t.Errorf("useTLS(%q) = true, want false", host)
+				}
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	flags := ParseBazelFlags([]string{
+		"--remote_cache=grpcs://cache.example.com",
+		"--tls_certificate=bazel-ca.pem",
+		"--tls_client_key=bazel.key",
+		"--remote_header=x-api-key=from-bazel",
+		"--remote_header=x-other=kept",
+		"--credential_helper=/bin/bazel-helper",
+	})
+	properties := &Credentials{
+		TLS:               true,
+		TLSCertificate:    "plugin-ca.pem",
+		Endpoints:         []string{"grpcs://other.example.com"},
+		Headers:           map[string][]string{"x-api-key": {"from-plugin"}},
+		CredentialHelpers: []CredentialHelper{{Path: "/bin/plugin-helper"}},
+	}
+	flags.Merge(properties)
+	flags.Merge(nil)
+
+	want := &Credentials{
+		TLS:            true,
+		TLSHosts:       []string{"cache.example.com"},
+		TLSCertificate: "plugin-ca.pem",
+		TLSClientKey:   "bazel.key",
+		Endpoints:      []string{"grpcs://cache.example.com", "grpcs://other.example.com"},
+		Headers:        map[string][]string{"x-api-key": {"from-plugin"}, "x-other": {"kept"}},
+		// The helpers of the properties come first, so they win over the ones of Bazel.
+		CredentialHelpers: []CredentialHelper{{Path: "/bin/plugin-helper"}, {Path: "/bin/bazel-helper"}},
+	}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("Merge() = %+v, want %+v", flags, want)
+	}
+	if h := flags.credentialHelper("cache.example.com"); h == nil || h.Path != "/bin/plugin-helper" {
+		t.Errorf("credentialHelper() = %+v, want the one of the properties", h)
+	}
+}
+
+func TestCredentialHelperScope(t *testing.T) {
+	creds := &Credentials{CredentialHelpers: []CredentialHelper{
+		{Path: "fallback"},
+		{Scope: "*.example.com", Path: "wildcard"},
+		{Scope: "cache.example.com", Path: "exact"},
+		{Scope: "*.example.com", Path: "second wildcard"},
+	}}
+	for host, want := range map[string]string{
+		"cache.example.com":  "exact",
+		"remote.example.com": "wildcard",
+		"a.b.example.com":    "wildcard",
+		"example.com":        "fallback",
+		"example.org":        "fallback",
+	} {
+		if h := creds.credentialHelper(host); h == nil || h.Path != want {
+			t.Errorf("credentialHelper(%q) = %+v, want %s", host, h, want)
+		}
+	}
+	if h := (&Credentials{CredentialHelpers: []CredentialHelper{{Scope: "cache.example.com"}}}).credentialHelper("example.org"); h != nil {
+		t.Errorf("credentialHelper() = %+v, want nil", h)
+	}
+}
+
+// fakeHelperScript implements the credential helper protocol, returning the URI it's asked about as a token and
+// the expiry found next to it. It appends a line to calls every time it runs.
+const fakeHelperScript = `#!/bin/sh
+cd "$(dirname "$0")" || exit 1
+[ "$1" = get ] || exit 2
+uri=$(sed 's/.*"uri":"\([^"]*\)".*/\1/')
+echo "$uri" >> calls
+printf '{"expires":"%s","headers":{"Authorization":["Bearer %s"]}}' "$(cat expires)" "$uri"
+`
+
+func TestCredentialHelper(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "helper"), []byte(fakeHelperScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	calls := func() int {
+		b, _ := os.ReadFile(filepath.Join(dir, "calls"))
+		return strings.Count(string(b), "\n")
+	}
+
+	// %workspace% stands for the working directory, the workspace Bazel runs in.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, tc := range []struct {
+		name    string
+		expires string
+		// wantCalls is how many times the helper runs for three requests.
+		wantCalls int
+	}{
+		{name: "not expired", expires: time.Now().Add(time.Hour).Format(time.RFC3339), wantCalls: 1},
+		{name: "no expiry", expires: "", wantCalls: 1},
+		{name: "expired", expires: time.Now().Add(-time.Hour).Format(time.RFC3339), wantCalls: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "calls"))
+			if err := os.WriteFile(filepath.Join(dir, "expires"), []byte(tc.expires), 0644); err != nil {
+				t.Fatal(err)
+			}
+			creds := ParseBazelFlags([]string{"--credential_helper=*.example.com=%workspace%/helper"})
+			hc := creds.headerCredentials("https", "cache.example.com:443", true)
+			if hc == nil {
+				t.Fatal("headerCredentials() = nil")
+			}
+			for i := 0; i < 3; i++ {
+				md, err := hc.GetRequestMetadata(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := "Bearer https://cache.example.com:443"; md["authorization"] != want {
+					t.Errorf("authorization = %q, want %q", md["authorization"], want)
+				}
+			}
+			if n := calls(); n != tc.wantCalls {
+				t.Errorf("the helper ran %d times, want %d", n, tc.wantCalls)
+			}
+		})
+	}
+
+	creds := ParseBazelFlags([]string{"--credential_helper=" + filepath.Join(dir, "missing")})
+	if _, err := creds.headerCredentials("https", "cache.example.com", true).GetRequestMetadata(context.Background()); err == nil {
+		t.Error("GetRequestMetadata() with a missing helper succeeded")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	ca := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		creds   *Credentials
+		wantErr string
+	}{
+		{name: "system roots", creds: &Credentials{}},
+		{name: "certificate authority", creds: &Credentials{TLSCertificate: ca}},
+		{name: "missing certificate", creds: &Credentials{TLSCertificate: filepath.Join(dir, "missing.pem")}, wantErr: "failed to read TLS certificate"},
+		{name: "invalid certificate", creds: &Credentials{TLSCertificate: invalid}, wantErr: "no certificates found"},
+		{name: "invalid client certificate", creds: &Credentials{TLSClientCertificate: invalid, TLSClientKey: invalid}, wantErr: "failed to load TLS client certificate"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := tc.creds.tlsConfig()
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("tlsConfig() error = %v, want %q", err, tc.wantErr)
+				}
+				// Dialing with TLS fails the same way.
+				if _, err := tc.creds.dialOptions("cache.example.com"); err == nil {
+					t.Error("dialOptions() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (cfg.RootCAs != nil) != (tc.creds.TLSCertificate != "") {
+				t.Errorf("tlsConfig() RootCAs = %v, want them set only with a certificate", cfg.RootCAs)
+			}
+			if _, err := tc.creds.dialOptions("cache.example.com"); err != nil {
+				t.Errorf("dialOptions() error = %v", err)
+			}
+		})
+	}
+}
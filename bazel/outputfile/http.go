@@ -0,0 +1,95 @@
+package outputfile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	httpMaxTries    = 5
+	httpBackoffBase = 500 * time.Millisecond
+
+	// httpResponseHeaderTimeout is how long a server has to start responding, before the request is retried.
+	httpResponseHeaderTimeout = 60 * time.Second
+	// httpTimeout bounds a whole request, body included. It's generous, as outputs are streamed and can be large.
+	httpTimeout = 10 * time.Minute
+)
+
+// newHTTPClient returns the client outputs are fetched with, giving up on servers which stop responding.
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = httpResponseHeaderTimeout
+	return &http.Client{Transport: transport, Timeout: httpTimeout}
+}
+
+// httpReader fetches an output served over HTTP(S), as returned by some remote caches and build event services.
+// The configured headers are sent along the request, and transient failures are retried with an exponential
+// backoff. The body is streamed, it's up to the caller to close it.
+func (c *Client) httpReader(ctx context.Context, uri *url.URL) (io.ReadCloser, error) {
+	auth := c.httpHeaderCredentials(uri)
+
+	backoff := httpBackoffBase
+	var lastErr error
+	for tries := 0; tries < httpMaxTries; tries++ {
+		if tries > 0 {
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", uri.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			md, err := auth.GetRequestMetadata(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range md {
+				req.Header.Set(k, v)
+			}
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp.Body, nil
+		}
+		resp.Body.Close()
+		lastErr = fmt.Errorf("GET %s: status code = %d", uri.Redacted(), resp.StatusCode)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// httpHeaderCredentials returns the source of the headers to send to the host of uri, reusing the same one
+// across requests so the responses of credential helpers are cached.
+func (c *Client) httpHeaderCredentials(uri *url.URL) *headerCredentials {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := uri.Scheme + "://" + uri.Host
+	if hc, ok := c.httpAuth[key]; ok {
+		return hc
+	}
+	hc := c.credentials.headerCredentials(uri.Scheme, uri.Host, uri.Scheme == "https")
+	c.httpAuth[key] = hc
+	return hc
+}
@@ -4,22 +4,67 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/sourcegraph/aspect-cli-plugin-buildkite/bazel/bytestream"
 	"google.golang.org/grpc"
 )
 
+// Client reads outputs from their URIs. It's safe for concurrent use, but it must be configured (see Register,
+// SetCredentials and SetCacheDir) while no outputs are being read.
 type Client struct {
+	resolvers   map[string]Resolver
+	cacheDir    string
+	credentials *Credentials
+	httpClient  *http.Client
+
+	// mu guards the fields below.
+	mu              sync.Mutex
 	bytestreamConns map[string]*grpc.ClientConn
+	httpAuth        map[string]*headerCredentials
+	// blobLocks makes sure each blob is only fetched once at a time to be put in the cache.
+	blobLocks map[string]*sync.Mutex
 }
 
 func NewClient() *Client {
-	return &Client{
+	c := &Client{
 		bytestreamConns: map[string]*grpc.ClientConn{},
+		credentials:     &Credentials{},
+		httpClient:      newHTTPClient(),
+		httpAuth:        map[string]*headerCredentials{},
+		blobLocks:       map[string]*sync.Mutex{},
+	}
+	c.resolvers = map[string]Resolver{
+		"file":       fileResolver{},
+		"bytestream": bytestreamResolver{c},
+		"http":       ResolverFunc(c.httpReader),
+		"https":      ResolverFunc(c.httpReader),
 	}
+	return c
+}
+
+// SetCredentials sets the credentials used to connect to remote caches. It only applies to connections
+// that are yet to be established.
+func (c *Client) SetCredentials(creds *Credentials) {
+	if creds == nil {
+		creds = &Credentials{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credentials = creds
+	c.httpAuth = map[string]*headerCredentials{}
+}
+
+func (c *Client) resolver(u *url.URL) (Resolver, error) {
+	r, ok := c.resolvers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("scheme not implemented %q (%q)", u.Scheme, u.String())
+	}
+	return r, nil
 }
 
 func (c *Client) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
@@ -27,67 +72,87 @@ func (c *Client) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	switch u.Scheme {
-	case "file":
-		return c.fileReader(u)
-	case "bytestream":
-		return c.bytestreamReader(ctx, u)
-	default:
-		return nil, fmt.Errorf("scheme not implemented %q (%q)", u.Scheme, u.String())
+	r, err := c.resolver(u)
+	if err != nil {
+		return nil, err
 	}
+	if d, ok := c.cacheDigest(u); ok {
+		path, err := c.cachedBlob(ctx, r, u, d)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(path)
+	}
+	return c.open(ctx, r, u)
 }
 
-func (c *Client) GetFilePath(ctx context.Context, uri string, name string) (string, error) {
+// GetFilePath returns a path on the local filesystem where the output at uri can be read. Outputs that are
+// already local are not copied and their own path is returned, others are downloaded to dest.
+func (c *Client) GetFilePath(ctx context.Context, uri string, dest string) (string, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return "", err
 	}
-	switch u.Scheme {
-	case "file":
-		// If it's a file, we just return the path on the local filesystem.
-		return u.Path, nil
-	case "bytestream":
-		// If it's a bytestream, we need to fetch it and put it somewhere in the
-		// local filesystem.
-		rc, err := c.bytestreamReader(ctx, u)
-		if err != nil {
-			return "", err
-		}
-		defer rc.Close()
-		path, err := os.MkdirTemp(".", "_bk_artefacts_")
-		if err != nil {
-			return "", err
-		}
-		outputPath := filepath.Join(path, name)
-		f, err := os.Create(outputPath)
+	r, err := c.resolver(u)
+	if err != nil {
+		return "", err
+	}
+	// If it's a local file, we just return its path on the local filesystem.
+	if local, ok := r.(LocalResolver); ok {
+		return local.LocalPath(u)
+	}
+
+	// Otherwise, we need to fetch it and put it at dest.
+	if d, ok := c.cacheDigest(u); ok {
+		path, err := c.cachedBlob(ctx, r, u, d)
 		if err != nil {
 			return "", err
 		}
-		defer f.Close()
-		if _, err := io.Copy(f, rc); err != nil {
-			return "", err
-		}
-		if err := f.Sync(); err != nil {
+		if err := linkOrCopy(path, dest); err != nil {
 			return "", err
 		}
-		return outputPath, nil
-	default:
-		return "", fmt.Errorf("scheme not implemented %q (%q)", u.Scheme, u.String())
+		return dest, nil
 	}
-
+	rc, err := c.open(ctx, r, u)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, rc); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	return dest, nil
 }
 
 func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, conn := range c.bytestreamConns {
 		conn.Close()
 	}
 }
 
 func (c *Client) bytestreamClient(ctx context.Context, uri *url.URL) (*bytestream.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	conn, ok := c.bytestreamConns[uri.Host]
 	if !ok {
-		var err error
-		conn, err = grpc.DialContext(ctx, uri.Host, grpc.WithInsecure())
+		opts, err := c.credentials.dialOptions(uri.Host)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = grpc.DialContext(ctx, uri.Host, opts...)
 		if err != nil {
 			return nil, err
 		}
@@ -96,14 +161,19 @@ func (c *Client) bytestreamClient(ctx context.Context, uri *url.URL) (*bytestrea
 	return bytestream.NewClient(conn), nil
 }
 
-func (c *Client) bytestreamReader(ctx context.Context, uri *url.URL) (io.ReadCloser, error) {
-	cl, err := c.bytestreamClient(ctx, uri)
+// bytestreamResolver opens bytestream:// URIs, which point to a remote cache.
+type bytestreamResolver struct {
+	c *Client
+}
+
+func (r bytestreamResolver) Open(ctx context.Context, uri *url.URL) (io.ReadCloser, error) {
+	return r.OpenRange(ctx, uri, 0, 0)
+}
+
+func (r bytestreamResolver) OpenRange(ctx context.Context, uri *url.URL, offset int64, limit int64) (io.ReadCloser, error) {
+	cl, err := r.c.bytestreamClient(ctx, uri)
 	if err != nil {
 		return nil, err
 	}
-	return cl.NewReader(ctx, uri.Path)
-}
-
-func (c *Client) fileReader(uri *url.URL) (io.ReadCloser, error) {
-	return os.Open(uri.Path)
+	return cl.NewReaderRange(ctx, uri.Path, offset, limit)
 }
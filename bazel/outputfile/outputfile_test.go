@@ -0,0 +1,260 @@
+package outputfile
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/aspect-cli-plugin-buildkite/bazel/bytestream/bytestreamtest"
+)
+
+func newTestServer(t *testing.T) (*bytestreamtest.Server, *Client) {
+	t.Helper()
+	server, err := bytestreamtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	c := NewClient()
+	t.Cleanup(c.Close)
+	return server, c
+}
+
+// readAll returns a function reading all of what the output opened by Open or one of its variants holds.
+func readAll(t *testing.T) func(rc io.ReadCloser, err error) string {
+	return func(rc io.ReadCloser, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+}
+
+func TestGetFilePathCachesBlobs(t *testing.T) {
+	server, c := newTestServer(t)
+	dir := t.TempDir()
+	c.SetCacheDir(filepath.Join(dir, "cache"))
+	uri := server.PutBlob([]byte("hello world"))
+
+	ctx := context.Background()
+	for _, dest := range []string{"a/test.log", "b/test.log"} {
+		path, err := c.GetFilePath(ctx, uri, filepath.Join(dir, dest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(path); err != nil || string(b) != "hello world" {
+			t.Errorf("GetFilePath(%q) = %q, %v, want %q", dest, b, err, "hello world")
+		}
+	}
+	if got := readAll(t)(c.Open(ctx, uri)); got != "hello world" {
+		t.Errorf("Open() = %q, want %q", got, "hello world")
+	}
+	if n := server.Reads(); n != 1 {
+		t.Errorf("server got %d reads, want 1", n)
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	server, c := newTestServer(t)
+	dir := t.TempDir()
+	c.SetCacheDir(filepath.Join(dir, "cache"))
+	ctx := context.Background()
+	oldURI := server.PutBlob([]byte("old"))
+	usedURI := server.PutBlob([]byte("used"))
+	for _, uri := range []string{oldURI, usedURI} {
+		if _, err := c.GetFilePath(ctx, uri, filepath.Join(dir, "out", filepath.Base(uri))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Age both blobs, then use one of them again.
+	long := time.Now().Add(-48 * time.Hour)
+	for _, data := range []string{"old", "used"} {
+		d, _ := ParseDigest(bytestreamtest.BlobResourceName([]byte(data)))
+		if err := os.Chtimes(c.cachePath(d), long, long); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readAll(t)(c.Open(ctx, usedURI))
+
+	if n, err := c.PruneCache(24 * time.Hour); err != nil || n != 1 {
+		t.Fatalf("PruneCache() = %d, %v, want 1 blob removed", n, err)
+	}
+	if got := readAll(t)(c.Open(ctx, usedURI)); got != "used" {
+		t.Errorf("Open() of the blob used recently = %q, want %q", got, "used")
+	}
+	if got := readAll(t)(c.Open(ctx, oldURI)); got != "old" {
+		t.Errorf("Open() of the pruned blob = %q, want %q", got, "old")
+	}
+	if n := server.Reads(); n != 3 {
+		t.Errorf("server got %d reads, want 3 as only the pruned blob is fetched again", n)
+	}
+}
+
+func TestOpenVerifiesDigest(t *testing.T) {
+	server, c := newTestServer(t)
+	// Serve different content than the one the digest was computed from.
+	name := bytestreamtest.BlobResourceName([]byte("hello world"))
+	server.Put(name, []byte("hello w0rld"))
+
+	rc, err := c.Open(context.Background(), server.URI(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	_, err = io.ReadAll(rc)
+	var mismatch *DigestMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("ReadAll() error = %v, want a *DigestMismatchError", err)
+	}
+}
+
+func TestUnsupportedDigestFunction(t *testing.T) {
+	server, c := newTestServer(t)
+	dir := t.TempDir()
+	c.SetCacheDir(filepath.Join(dir, "cache"))
+	// Go doesn't implement blake3, so only the size of the blob can be verified.
+	hash := strings.Repeat("ab", 32)
+	name := "blobs/blake3/" + hash + "/11"
+	server.Put(name, []byte("hello world"))
+	ctx := context.Background()
+	for _, dest := range []string{"a/test.log", "b/test.log"} {
+		path, err := c.GetFilePath(ctx, server.URI(name), filepath.Join(dir, dest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(path); err != nil || string(b) != "hello world" {
+			t.Errorf("GetFilePath(%q) = %q, %v, want %q", dest, b, err, "hello world")
+		}
+	}
+	if n := server.Reads(); n != 2 {
+		t.Errorf("server got %d reads, want 2 as such blobs are not cached", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cache", "blake3")); !os.IsNotExist(err) {
+		t.Errorf("the blob was put in the cache: %v", err)
+	}
+
+	truncated := "blobs/blake3/" + hash + "/12"
+	server.Put(truncated, []byte("hello world"))
+	_, err := c.GetFilePath(ctx, server.URI(truncated), filepath.Join(dir, "c/test.log"))
+	var mismatch *DigestMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Errorf("GetFilePath() of a truncated blob error = %v, want a *DigestMismatchError", err)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	server, c := newTestServer(t)
+	content := strings.Repeat("0123456789", 20000)
+	uri := server.PutBlob([]byte(content))
+
+	ctx := context.Background()
+	if got := readAll(t)(c.Head(ctx, uri, 5)); got != "01234" {
+		t.Errorf("Head() = %q, want %q", got, "01234")
+	}
+	if got := readAll(t)(c.Tail(ctx, uri, 5)); got != "56789" {
+		t.Errorf("Tail() = %q, want %q", got, "56789")
+	}
+	if got := readAll(t)(c.OpenRange(ctx, uri, 99998, 4)); got != "8901" {
+		t.Errorf("OpenRange() = %q, want %q", got, "8901")
+	}
+	if got := readAll(t)(c.Tail(ctx, uri, int64(len(content))+10)); got != content {
+		t.Errorf("Tail() returned %d bytes, want the whole %d", len(got), len(content))
+	}
+}
+
+func TestUpload(t *testing.T) {
+	server, c := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "summary.md")
+	if err := os.WriteFile(path, []byte("# Summary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	uri, err := c.Upload(ctx, "bytestream://"+server.Addr()+"/main", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := server.URI("main/" + bytestreamtest.BlobResourceName([]byte("# Summary"))); uri != want {
+		t.Errorf("Upload() = %q, want %q", uri, want)
+	}
+	if got := readAll(t)(c.Open(ctx, uri)); got != "# Summary" {
+		t.Errorf("Open() = %q, want %q", got, "# Summary")
+	}
+}
+
+func TestHTTPReaderRetriesStalledServer(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Stall until the client gives up.
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, "PASS: //server:server_test")
+	}))
+	defer server.Close()
+
+	c := NewClient()
+	defer c.Close()
+	c.httpClient.Transport.(*http.Transport).ResponseHeaderTimeout = 50 * time.Millisecond
+	if got := readAll(t)(c.Open(context.Background(), server.URL+"/test.log")); got != "PASS: //server:server_test" {
+		t.Errorf("Open() read %q", got)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("server got %d requests, want 2", n)
+	}
+}
+
+func TestHTTPHeadersOnlySentToEndpoints(t *testing.T) {
+	newServer := func() (*httptest.Server, *string) {
+		var authorization string
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			io.WriteString(w, "ok")
+		}))
+		t.Cleanup(s.Close)
+		return s, &authorization
+	}
+	cache, cacheAuth := newServer()
+	other, otherAuth := newServer()
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		want     string
+	}{
+		{name: "plaintext endpoint", endpoint: cache.URL, want: "Bearer secret"},
+		{name: "endpoint over TLS", endpoint: strings.Replace(cache.URL, "http://", "grpcs://", 1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			creds := ParseBazelFlags([]string{"--remote_cache=" + tc.endpoint, "--remote_header=Authorization=Bearer secret"})
+			c := NewClient()
+			defer c.Close()
+			c.SetCredentials(creds)
+
+			*cacheAuth, *otherAuth = "", ""
+			readAll(t)(c.Open(context.Background(), cache.URL+"/test.log"))
+			readAll(t)(c.Open(context.Background(), other.URL+"/test.log"))
+			if *cacheAuth != tc.want {
+				t.Errorf("cache got Authorization %q, want %q", *cacheAuth, tc.want)
+			}
+			if *otherAuth != "" {
+				t.Errorf("other host got Authorization %q, want none", *otherAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package outputfile
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"os"
+)
+
+// OpenRange opens the output at uri to read at most limit bytes from offset, or until the end if limit is 0.
+// Outputs that are not cached locally are only partially fetched when their resolver is a RangeResolver, and
+// read from the start otherwise, skipping what comes before offset.
+//
+// Unlike Open, it doesn't verify the digest of partially read blobs, as it can only be computed from all of
+// their content.
+func (c *Client) OpenRange(ctx context.Context, uri string, offset int64, limit int64) (io.ReadCloser, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.resolver(u)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 && limit == 0 {
+		return c.Open(ctx, uri)
+	}
+	if path, ok := c.cachedPath(u); ok {
+		return openFileRange(path, offset, limit)
+	}
+	if rr, ok := r.(RangeResolver); ok {
+		return rr.OpenRange(ctx, u, offset, limit)
+	}
+
+	rc, err := c.open(ctx, r, u)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	return limitReadCloser(rc, limit), nil
+}
+
+// Head opens the output at uri to read its first n bytes.
+func (c *Client) Head(ctx context.Context, uri string, n int64) (io.ReadCloser, error) {
+	return c.OpenRange(ctx, uri, 0, n)
+}
+
+// Tail opens the output at uri to read its last n bytes. Only those are fetched when the size of the output
+// is known, i.e. for local files and blobs whose resource name has a digest. Other outputs are read in full,
+// keeping the last n bytes in memory.
+func (c *Client) Tail(ctx context.Context, uri string, n int64) (io.ReadCloser, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if size, ok := c.size(u); ok {
+		if size <= n {
+			return c.Open(ctx, uri)
+		}
+		return c.OpenRange(ctx, uri, size-n, 0)
+	}
+
+	rc, err := c.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	tail := &tailBuffer{n: int(n)}
+	if _, err := io.Copy(tail, rc); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(tail.bytes())), nil
+}
+
+// size returns the size of the output at u, if it can be known without reading it.
+func (c *Client) size(u *url.URL) (int64, bool) {
+	if u.Scheme == "bytestream" {
+		if d, ok := ParseDigest(u.Path); ok {
+			return d.Size, true
+		}
+		return 0, false
+	}
+	r, err := c.resolver(u)
+	if err != nil {
+		return 0, false
+	}
+	local, ok := r.(LocalResolver)
+	if !ok {
+		return 0, false
+	}
+	path, err := local.LocalPath(u)
+	if err != nil {
+		return 0, false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// cachedPath returns the path of the blob at u in the cache, if it's been fetched already.
+func (c *Client) cachedPath(u *url.URL) (string, bool) {
+	d, ok := c.cacheDigest(u)
+	if !ok {
+		return "", false
+	}
+	path := c.cachePath(d)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+func openFileRange(path string, offset int64, limit int64) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return limitReadCloser(f, limit), nil
+}
+
+// limitReadCloser limits rc to n bytes, unless n is 0.
+func limitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n == 0 {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, n), rc}
+}
+
+// tailBuffer keeps the last n bytes written to it.
+type tailBuffer struct {
+	n   int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > 2*t.n {
+		// Only compact from time to time, to avoid copying the buffer on every write.
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.n:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) bytes() []byte {
+	if len(t.buf) > t.n {
+		return t.buf[len(t.buf)-t.n:]
+	}
+	return t.buf
+}
@@ -0,0 +1,57 @@
+package outputfile
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+)
+
+// Resolver opens the outputs whose URIs use the scheme it's registered for, see Client.Register.
+type Resolver interface {
+	Open(ctx context.Context, uri *url.URL) (io.ReadCloser, error)
+}
+
+// LocalResolver is a Resolver whose outputs are already on the local filesystem, and don't need
+// to be copied to be given a path.
+type LocalResolver interface {
+	Resolver
+	LocalPath(uri *url.URL) (string, error)
+}
+
+// RangeResolver is a Resolver which can read parts of its outputs without reading them from the start, see
+// Client.OpenRange.
+type RangeResolver interface {
+	Resolver
+	// OpenRange opens the output at uri, to read at most limit bytes from offset, or until the end if limit is 0.
+	OpenRange(ctx context.Context, uri *url.URL, offset int64, limit int64) (io.ReadCloser, error)
+}
+
+// ResolverFunc adapts a function to a Resolver.
+type ResolverFunc func(ctx context.Context, uri *url.URL) (io.ReadCloser, error)
+
+// Open calls f(ctx, uri).
+func (f ResolverFunc) Open(ctx context.Context, uri *url.URL) (io.ReadCloser, error) {
+	return f(ctx, uri)
+}
+
+// Register makes the client use r to open the URIs with the given scheme, replacing the resolver previously
+// registered for it, if any. The "file", "bytestream", "http" and "https" schemes are registered by default.
+func (c *Client) Register(scheme string, r Resolver) {
+	c.resolvers[scheme] = r
+}
+
+// fileResolver opens file:// URIs, which point to the local filesystem.
+type fileResolver struct{}
+
+func (fileResolver) Open(_ context.Context, uri *url.URL) (io.ReadCloser, error) {
+	return os.Open(uri.Path)
+}
+
+func (fileResolver) LocalPath(uri *url.URL) (string, error) {
+	return uri.Path, nil
+}
+
+func (fileResolver) OpenRange(_ context.Context, uri *url.URL, offset int64, limit int64) (io.ReadCloser, error) {
+	return openFileRange(uri.Path, offset, limit)
+}
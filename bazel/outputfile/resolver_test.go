@@ -0,0 +1,128 @@
+package outputfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sourcegraph/aspect-cli-plugin-buildkite/bazel/bytestream/bytestreamtest"
+)
+
+// memResolver serves outputs from memory, by path, counting how many times each is opened. It's not a
+// RangeResolver, so partial reads go through the fallback of Client.OpenRange.
+type memResolver struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	opens map[string]int
+}
+
+func newMemResolver(files map[string][]byte) *memResolver {
+	return &memResolver{files: files, opens: map[string]int{}}
+}
+
+func (r *memResolver) Open(_ context.Context, uri *url.URL) (io.ReadCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.files[uri.Path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	r.opens[uri.Path]++
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (r *memResolver) Opens(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.opens[path]
+}
+
+func TestRegisterResolver(t *testing.T) {
+	ctx := context.Background()
+	c := NewClient()
+	defer c.Close()
+	r := newMemResolver(map[string][]byte{"/test.log": []byte("0123456789")})
+	c.Register("mem", r)
+
+	read := readAll(t)
+	if got := read(c.Open(ctx, "mem://host/test.log")); got != "0123456789" {
+		t.Errorf("Open() read %q", got)
+	}
+	if got := read(c.OpenRange(ctx, "mem://host/test.log", 2, 3)); got != "234" {
+		t.Errorf("OpenRange() read %q, want 234", got)
+	}
+	if got := read(c.OpenRange(ctx, "mem://host/test.log", 8, 0)); got != "89" {
+		t.Errorf("OpenRange() to the end read %q, want 89", got)
+	}
+	if got := read(c.Tail(ctx, "mem://host/test.log", 4)); got != "6789" {
+		t.Errorf("Tail() read %q, want 6789", got)
+	}
+	if _, err := c.Open(ctx, "mem://host/missing.log"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open() of a missing output error = %v, want the one of the resolver", err)
+	}
+	if _, err := c.Open(ctx, "unknown://host/test.log"); err == nil {
+		t.Error("Open() with an unregistered scheme succeeded")
+	}
+}
+
+func TestRegisterResolverCachesBlobs(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("PASS: //server:server_test\n")
+	blob := "/" + bytestreamtest.BlobResourceName(data)
+	corrupted := "/" + bytestreamtest.BlobResourceName([]byte("PASS: //client:client_test\n"))
+	r := newMemResolver(map[string][]byte{blob: data, corrupted: []byte("FAIL: //client:client_test\n")})
+
+	c := NewClient()
+	defer c.Close()
+	c.SetCacheDir(t.TempDir())
+	// Overriding the bytestream scheme keeps the digest cache and verification.
+	c.Register("bytestream", r)
+
+	dir := t.TempDir()
+	for _, name := range []string{"a.log", "b.log"} {
+		path, err := c.GetFilePath(ctx, "bytestream://cache"+blob, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(path); err != nil || !bytes.Equal(b, data) {
+			t.Errorf("GetFilePath() wrote %q, %v, want %q", b, err, data)
+		}
+	}
+	if got := readAll(t)(c.Open(ctx, "bytestream://cache"+blob)); got != string(data) {
+		t.Errorf("Open() read %q", got)
+	}
+	if n := r.Opens(blob); n != 1 {
+		t.Errorf("the blob was fetched %d times, want 1", n)
+	}
+
+	var mismatch *DigestMismatchError
+	if _, err := c.GetFilePath(ctx, "bytestream://cache"+corrupted, filepath.Join(dir, "c.log")); !errors.As(err, &mismatch) {
+		t.Errorf("GetFilePath() of a corrupted blob error = %v, want a *DigestMismatchError", err)
+	}
+}
+
+func TestRegisterResolverOverridesFile(t *testing.T) {
+	ctx := context.Background()
+	c := NewClient()
+	defer c.Close()
+	c.Register("file", newMemResolver(map[string][]byte{"/tmp/test.log": []byte("from memory")}))
+
+	if got := readAll(t)(c.Open(ctx, "file:///tmp/test.log")); got != "from memory" {
+		t.Errorf("Open() read %q", got)
+	}
+	// The resolver isn't a LocalResolver anymore, so the output is copied to dest.
+	dest := filepath.Join(t.TempDir(), "test.log")
+	path, err := c.GetFilePath(ctx, "file:///tmp/test.log", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); path != dest || err != nil || string(b) != "from memory" {
+		t.Errorf("GetFilePath() = %s with %q, %v, want %s", path, b, err, dest)
+	}
+}
@@ -0,0 +1,52 @@
+package outputfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/google/uuid"
+)
+
+// Upload writes the file at localPath to the content-addressable storage of the remote cache at remote, a
+// "bytestream://host[/instance_name]" URI, and returns the bytestream URI it can then be read from. Interrupted
+// writes are resumed, and nothing is sent if the remote cache already has the file.
+func (c *Client) Upload(ctx context.Context, remote string, localPath string) (string, error) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "bytestream" {
+		return "", fmt.Errorf("scheme not supported for uploads %q (%q)", u.Scheme, remote)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	blob := path.Join("blobs", hex.EncodeToString(h.Sum(nil)), fmt.Sprint(size))
+
+	cl, err := c.bytestreamClient(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	// See https://github.com/bazelbuild/remote-apis/blob/main/build/bazel/remote/execution/v2/remote_execution.proto
+	// for the naming of the resources.
+	instance := path.Clean("/" + u.Path)
+	resourceName := path.Join(instance, "uploads", uuid.NewString(), blob)
+	if err := cl.WriteFrom(ctx, resourceName, f, size); err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", localPath, err)
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: path.Join(instance, blob)}).String(), nil
+}
@@ -0,0 +1,131 @@
+package outputfile
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+)
+
+// DigestMismatchError is returned when reading a blob whose content doesn't match the digest found in its
+// resource name, i.e. it got corrupted along the way.
+type DigestMismatchError struct {
+	// URI is the URI the blob was read from.
+	URI string
+	// Expected is the digest found in the resource name.
+	Expected Digest
+	// Hash and Size are the ones of the content that was actually read. Hash is empty when the content is
+	// larger than expected, as it's not read further.
+	Hash string
+	Size int64
+}
+
+func (e *DigestMismatchError) Error() string {
+	if e.Size != e.Expected.Size {
+		return fmt.Sprintf("blob %s is corrupted: expected %d bytes, got %d", e.URI, e.Expected.Size, e.Size)
+	}
+	return fmt.Sprintf("blob %s is corrupted: expected hash %s, got %s", e.URI, e.Expected.Hash, e.Hash)
+}
+
+// newDigestHash returns the hash function of the digest, inferring it from the length of the hash when the
+// digest function is not specified. It returns nil for the functions that are not supported, blake3 and
+// sha256tree, in which case only the size of the blob can be verified, and it's not cached (see cacheDigest).
+func newDigestHash(d Digest) hash.Hash {
+	function := d.Function
+	if function == "" {
+		switch len(d.Hash) {
+		case 2 * md5.Size:
+			function = "md5"
+		case 2 * sha1.Size:
+			function = "sha1"
+		case 2 * sha256.Size:
+			function = "sha256"
+		case 2 * sha512.Size384:
+			function = "sha384"
+		case 2 * sha512.Size:
+			function = "sha512"
+		}
+	}
+	switch function {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha384":
+		return sha512.New384()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// open opens the blob at u with r, verifying its content against the digest in its resource name for
+// bytestream URIs.
+func (c *Client) open(ctx context.Context, r Resolver, u *url.URL) (io.ReadCloser, error) {
+	rc, err := r.Open(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "bytestream" {
+		return rc, nil
+	}
+	d, ok := ParseDigest(u.Path)
+	if !ok {
+		return rc, nil
+	}
+	return &verifyingReader{rc: rc, uri: u.String(), digest: d, hash: newDigestHash(d)}, nil
+}
+
+// verifyingReader hashes the content of a blob as it's read, and returns a *DigestMismatchError instead
+// of io.EOF if it doesn't match the expected digest.
+type verifyingReader struct {
+	rc     io.ReadCloser
+	uri    string
+	digest Digest
+	hash   hash.Hash
+	size   int64
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.size += int64(n)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	if r.size > r.digest.Size {
+		return n, &DigestMismatchError{URI: r.uri, Expected: r.digest, Size: r.size}
+	}
+	if err == io.EOF {
+		if err := r.verify(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) verify() error {
+	mismatch := &DigestMismatchError{URI: r.uri, Expected: r.digest, Size: r.size}
+	if r.size != r.digest.Size {
+		return mismatch
+	}
+	if r.hash == nil {
+		return nil
+	}
+	mismatch.Hash = hex.EncodeToString(r.hash.Sum(nil))
+	if mismatch.Hash != r.digest.Hash {
+		return mismatch
+	}
+	return nil
+}
+
+func (r *verifyingReader) Close() error {
+	return r.rc.Close()
+}
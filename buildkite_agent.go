@@ -1,14 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
 type BuildkiteAgent interface {
-	UploadArtifacts(ctx context.Context, glob string) error
+	// UploadArtifacts uploads the files matching glob, relative to dir, which is also what the
+	// paths of the artifacts are relative to.
+	UploadArtifacts(ctx context.Context, dir string, glob string) error
 	Annotate(ctx context.Context, style string, annotationContext string, markdown []byte) error
+	// MetaDataSet sets the build meta-data key to value, see https://buildkite.com/docs/agent/v3/cli-meta-data.
+	MetaDataSet(ctx context.Context, key string, value string) error
+	// MetaDataGet returns the value of the build meta-data key, failing if it isn't set.
+	MetaDataGet(ctx context.Context, key string) (string, error)
+	// PipelineUpload adds the steps of the YAML pipeline to the build, see
+	// https://buildkite.com/docs/agent/v3/cli-pipeline.
+	PipelineUpload(ctx context.Context, pipeline []byte) error
 }
 
 type buildkiteAgent struct {
@@ -23,8 +38,10 @@ func NewBuildkiteAgent(path string) BuildkiteAgent {
 	return &buildkiteAgent{path: p}
 }
 
-func (a *buildkiteAgent) UploadArtifacts(ctx context.Context, glob string) error {
-	return exec.CommandContext(ctx, a.path, "artifact", "upload", glob).Run()
+func (a *buildkiteAgent) UploadArtifacts(ctx context.Context, dir string, glob string) error {
+	cmd := exec.CommandContext(ctx, a.path, "artifact", "upload", glob)
+	cmd.Dir = dir
+	return cmd.Run()
 }
 
 func (a *buildkiteAgent) Annotate(ctx context.Context, style string, aCtx string, m []byte) error {
@@ -47,25 +64,113 @@ func (a *buildkiteAgent) Annotate(ctx context.Context, style string, aCtx string
 	return err
 }
 
+func (a *buildkiteAgent) MetaDataSet(ctx context.Context, key string, value string) error {
+	// The value is given on stdin rather than as an argument, as lists of labels can get long.
+	cmd := exec.CommandContext(ctx, a.path, "meta-data", "set", key)
+	cmd.Stdin = strings.NewReader(value)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (a *buildkiteAgent) MetaDataGet(ctx context.Context, key string) (string, error) {
+	cmd := exec.CommandContext(ctx, a.path, "meta-data", "get", key)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return string(out), nil
+}
+
+func (a *buildkiteAgent) PipelineUpload(ctx context.Context, pipeline []byte) error {
+	cmd := exec.CommandContext(ctx, a.path, "pipeline", "upload")
+	cmd.Stdin = bytes.NewReader(pipeline)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// mockBuildkiteAgent prints the buildkite-agent commands instead of running them, and renders the annotations
+// as HTML pages in previewDir, so their design can be iterated on locally.
 type mockBuildkiteAgent struct {
-	path string
+	path       string
+	previewDir string
+
+	mu sync.Mutex
+	// annotations holds the Markdown appended to each context so far, to render the whole annotation again.
+	annotations map[string]*strings.Builder
+	// metaData holds the meta-data set so far, so it can be read back.
+	metaData map[string]string
 }
 
-func NewMockBuildkiteAgent(path string) BuildkiteAgent {
+func NewMockBuildkiteAgent(path string, previewDir string) BuildkiteAgent {
 	p := "buildkite-agent"
 	if path != "" {
 		p = path
 	}
-	return &mockBuildkiteAgent{path: p}
+	if previewDir == "" {
+		previewDir = filepath.Join(os.TempDir(), defaultAnnotationPreviewDir)
+	}
+	return &mockBuildkiteAgent{path: p, previewDir: previewDir, annotations: map[string]*strings.Builder{}, metaData: map[string]string{}}
 }
 
-func (a *mockBuildkiteAgent) UploadArtifacts(ctx context.Context, glob string) error {
-	fmt.Printf("%s artifact upload %q\n", a.path, glob)
+func (a *mockBuildkiteAgent) UploadArtifacts(ctx context.Context, dir string, glob string) error {
+	fmt.Printf("(cd %q && %s artifact upload %q)\n", dir, a.path, glob)
 	return nil
 }
 
 func (a *mockBuildkiteAgent) Annotate(ctx context.Context, style string, aCtx string, m []byte) error {
-	fmt.Printf("%s annotate --style %s --context %s <<EOF", a.path, style, aCtx)
-	fmt.Printf("%sEOF", string(m))
+	fmt.Printf("%s annotate --style %s --context %s --append <<EOF\n", a.path, style, aCtx)
+	fmt.Print(string(m))
+	if len(m) > 0 && m[len(m)-1] != '\n' {
+		fmt.Println()
+	}
+	fmt.Println("EOF")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sb, ok := a.annotations[aCtx]
+	if !ok {
+		sb = &strings.Builder{}
+		a.annotations[aCtx] = sb
+	}
+	sb.Write(m)
+	path := filepath.Join(a.previewDir, url.PathEscape(aCtx)+".html")
+	if err := writeAnnotationPreview(path, style, aCtx, sb.String()); err != nil {
+		return fmt.Errorf("failed to preview annotation %s: %w", aCtx, err)
+	}
+	if !ok {
+		fmt.Printf("Annotation preview: file://%s\n", filepath.ToSlash(path))
+	}
+	return nil
+}
+
+func (a *mockBuildkiteAgent) MetaDataSet(ctx context.Context, key string, value string) error {
+	fmt.Printf("%s meta-data set %q <<EOF\n%s\nEOF\n", a.path, key, value)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metaData[key] = value
+	return nil
+}
+
+func (a *mockBuildkiteAgent) MetaDataGet(ctx context.Context, key string) (string, error) {
+	fmt.Printf("%s meta-data get %q\n", a.path, key)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	value, ok := a.metaData[key]
+	if !ok {
+		return "", fmt.Errorf("meta-data key %q not found", key)
+	}
+	return value, nil
+}
+
+func (a *mockBuildkiteAgent) PipelineUpload(ctx context.Context, pipeline []byte) error {
+	fmt.Printf("%s pipeline upload <<EOF\n%sEOF\n", a.path, pipeline)
 	return nil
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeAgentScript emulates the meta-data subcommands of buildkite-agent, with a file per key next to the script.
+const fakeAgentScript = `#!/bin/sh
+cd "$(dirname "$0")" || exit 1
+case "$1 $2" in
+"meta-data set") cat > "$3" ;;
+"meta-data get") if [ -f "$3" ]; then cat "$3"; else echo "key $3 not found" >&2; exit 1; fi ;;
+*) exit 2 ;;
+esac
+`
+
+func TestMetaData(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "buildkite-agent")
+	if err := os.WriteFile(script, []byte(fakeAgentScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, agent := range map[string]BuildkiteAgent{
+		"agent": NewBuildkiteAgent(script),
+		"mock":  NewMockBuildkiteAgent(script, t.TempDir()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			value := "//server:server_test\n//lib:lib"
+			if err := agent.MetaDataSet(ctx, name+".failed_labels", value); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := agent.MetaDataGet(ctx, name+".failed_labels"); err != nil || got != value {
+				t.Errorf("MetaDataGet() = %q, %v, want %q", got, err, value)
+			}
+			_, err := agent.MetaDataGet(ctx, name+".missing")
+			if err == nil {
+				t.Fatal("MetaDataGet() of a missing key succeeded")
+			}
+			if name == "agent" && !strings.Contains(err.Error(), "not found") {
+				t.Errorf("MetaDataGet() error = %v, want the output of the agent", err)
+			}
+		})
+	}
+}
@@ -1,25 +1,272 @@
+// Command mockagent is a local replacement for the buildkite-agent binary. It records every call made to it, and
+// emulates the few subcommands whose effects matter to the plugin, so a run can be inspected afterwards.
 package main
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+// Environment variables configuring where the mock agent keeps its state.
+const (
+	// dirEnv is the directory holding the transcript, the meta-data and the annotations.
+	dirEnv = "MOCK_AGENT_DIR"
+	// logEnv overrides the path of the transcript.
+	logEnv = "MOCK_AGENT_LOG"
+
+	defaultDir = "/tmp/mockagent"
+)
+
+// groupCommands are the commands of the real agent which have subcommands, e.g. "artifact upload".
+var groupCommands = map[string]bool{
+	"annotation": true,
+	"artifact":   true,
+	"env":        true,
+	"lock":       true,
+	"meta-data":  true,
+	"oidc":       true,
+	"pipeline":   true,
+	"secret":     true,
+	"step":       true,
+}
+
+// boolFlags are the flags of the real agent which don't take a value.
+var boolFlags = map[string]bool{
+	"append":           true,
+	"debug":            true,
+	"no-color":         true,
+	"no-interpolation": true,
+	"replace":          true,
+}
+
+// record is a line of the transcript, describing a call made to the agent. Its working directory is recorded, as
+// the paths given to the agent, such as the artifacts to upload, are relative to it.
+type record struct {
+	Time       time.Time         `json:"time"`
+	Cwd        string            `json:"cwd"`
+	Subcommand string            `json:"subcommand"`
+	Args       []string          `json:"args,omitempty"`
+	Flags      map[string]string `json:"flags,omitempty"`
+	Stdin      string            `json:"stdin,omitempty"`
+}
+
 func main() {
-	f, err := os.Create("/tmp/_log_mock_agent.txt")
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "mockagent:", err)
+		var exit exitError
+		if errors.As(err, &exit) {
+			os.Exit(int(exit))
+		}
+		os.Exit(1)
+	}
+}
+
+// exitError makes the agent exit with the given status, as the real one does in some cases.
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func run(args []string, stdin *os.File, stdout io.Writer) error {
+	dir := os.Getenv(dirEnv)
+	if dir == "" {
+		dir = defaultDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	rec := parseArgs(args)
+	rec.Time = time.Now().UTC()
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	rec.Cwd = cwd
+	// Like the real agent, only read stdin when the input isn't given as an argument, and never from a terminal.
+	if info, err := stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 && readsStdin(rec) {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		rec.Stdin = string(b)
+	}
+	logPath := os.Getenv(logEnv)
+	if logPath == "" {
+		logPath = filepath.Join(dir, "transcript.jsonl")
+	}
+	if err := appendRecord(logPath, rec); err != nil {
+		return err
+	}
+
+	switch rec.Subcommand {
+	case "meta-data set", "meta-data get", "meta-data exists", "meta-data keys":
+		return metaData(filepath.Join(dir, "meta-data"), rec, stdout)
+	case "annotate", "annotation remove":
+		return annotate(filepath.Join(dir, "annotations"), rec)
+	}
+	return nil
+}
+
+// parseArgs tells apart the subcommand, its flags and its positional arguments.
+func parseArgs(args []string) record {
+	rec := record{Flags: map[string]string{}}
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if k, v, ok := strings.Cut(name, "="); ok {
+			rec.Flags[k] = v
+		} else if boolFlags[name] || i+1 == len(args) {
+			rec.Flags[name] = "true"
+		} else {
+			rec.Flags[name] = args[i+1]
+			i++
+		}
+	}
+	if len(positional) > 0 {
+		rec.Subcommand = positional[0]
+		positional = positional[1:]
+		if groupCommands[rec.Subcommand] && len(positional) > 0 {
+			rec.Subcommand += " " + positional[0]
+			positional = positional[1:]
+		}
+	}
+	rec.Args = positional
+	return rec
+}
+
+// readsStdin returns true for the subcommands taking their input from stdin when it's not given as an argument.
+func readsStdin(rec record) bool {
+	switch rec.Subcommand {
+	case "annotate", "pipeline upload":
+		return len(rec.Args) == 0
+	case "meta-data set":
+		return len(rec.Args) == 1
+	}
+	return false
+}
+
+// appendRecord appends the record to the transcript at path, as a single write so concurrent calls don't
+// interleave their records.
+func appendRecord(path string, rec record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// metaData emulates the meta-data subcommands with a local store, holding a file per key in dir.
+func metaData(dir string, rec record, stdout io.Writer) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if rec.Subcommand == "meta-data keys" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for _, e := range entries {
+			if k, err := url.PathUnescape(e.Name()); err == nil {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintln(stdout, k)
+		}
+		return nil
 	}
 
-	for i, arg := range os.Args {
-		fmt.Fprintln(f, "arg", i, "=", arg)
+	if len(rec.Args) == 0 {
+		return errors.New("missing meta-data key")
+	}
+	path := filepath.Join(dir, url.PathEscape(rec.Args[0]))
+	switch rec.Subcommand {
+	case "meta-data set":
+		value := rec.Stdin
+		if len(rec.Args) > 1 {
+			value = rec.Args[1]
+		}
+		return os.WriteFile(path, []byte(value), 0644)
+	case "meta-data exists":
+		if _, err := os.Stat(path); err != nil {
+			// The real agent exits with 100 when the key doesn't exist.
+			return exitError(100)
+		}
+		return nil
+	default:
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			if def, ok := rec.Flags["default"]; ok {
+				b, err = []byte(def), nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("meta-data key %q not found", rec.Args[0])
+		}
+		_, err = stdout.Write(b)
+		return err
+	}
+}
+
+// annotate reconstructs the annotations, as the Buildkite UI would show them, in a Markdown file per context
+// in dir.
+func annotate(dir string, rec record) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	context := rec.Flags["context"]
+	if context == "" {
+		context = "default"
 	}
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		fmt.Fprintln(f, scanner.Text())
+	path := filepath.Join(dir, url.PathEscape(context)+".md")
+
+	if rec.Subcommand == "annotation remove" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	body := rec.Stdin
+	if len(rec.Args) > 0 {
+		body = rec.Args[0]
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if rec.Flags["append"] == "true" {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
 	}
-	if scanner.Err() != nil {
-		panic(scanner.Err)
+	defer f.Close()
+	if _, err := f.WriteString(body); err != nil {
+		return err
 	}
+	return f.Close()
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// call runs the mock agent with args, feeding it stdin, and returns what it printed.
+func call(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := w.WriteString(stdin); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	var stdout strings.Builder
+	err = run(args, r, &stdout)
+	return stdout.String(), err
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(dirEnv, dir)
+	t.Setenv(logEnv, "")
+
+	for _, c := range []struct {
+		stdin string
+		args  []string
+	}{
+		{stdin: "//server:server_test", args: []string{"meta-data", "set", "failed_labels"}},
+		{stdin: "**Failed test**\n", args: []string{"annotate", "--style", "error", "--context", "failed_tests", "--append"}},
+		{args: []string{"annotate", "--context=failed_tests", "--append", "`//server:server_test`\n"}},
+		{args: []string{"artifact", "upload", "server/server_test/test.log"}},
+	} {
+		if _, err := call(t, c.stdin, c.args...); err != nil {
+			t.Fatalf("%v: %v", c.args, err)
+		}
+	}
+
+	if out, err := call(t, "", "meta-data", "get", "failed_labels"); err != nil || out != "//server:server_test" {
+		t.Errorf("meta-data get = %q, %v, want //server:server_test", out, err)
+	}
+	if out, err := call(t, "", "meta-data", "get", "missing", "--default", "none"); err != nil || out != "none" {
+		t.Errorf("meta-data get of a missing key = %q, %v, want the default", out, err)
+	}
+	var exit exitError
+	if _, err := call(t, "", "meta-data", "exists", "missing"); !errors.As(err, &exit) || exit != 100 {
+		t.Errorf("meta-data exists of a missing key = %v, want exit status 100", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "annotations", "failed_tests.md"))
+	if want := "**Failed test**\n`//server:server_test`\n"; err != nil || string(b) != want {
+		t.Errorf("annotations/failed_tests.md = %q, %v, want %q", b, err, want)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "transcript.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 7 {
+		t.Fatalf("transcript has %d records, want 7", len(records))
+	}
+	upload := records[3]
+	if upload.Subcommand != "artifact upload" || strings.Join(upload.Args, " ") != "server/server_test/test.log" || upload.Cwd != cwd {
+		t.Errorf("artifact upload recorded as %+v, want its path and cwd %s", upload, cwd)
+	}
+	if annotate := records[1]; annotate.Flags["context"] != "failed_tests" || annotate.Flags["append"] != "true" || annotate.Stdin != "**Failed test**\n" {
+		t.Errorf("annotate recorded as %+v", annotate)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// defaultConcurrency is how many outputs are fetched and uploaded at once, unless configured otherwise.
+const defaultConcurrency = 8
+
+// forEach calls fn with every index in [0, n), running up to p.concurrency calls at once. It waits for all of them
+// to return, even if some fail, and returns their errors aggregated in the order of the indices.
+//
+// Calls complete in any order, so fn should store its results at its index, for them to be used in order once
+// forEach returns.
+func (p *BuildkitePlugin) forEach(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	concurrency := p.concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	errs := make([]error, n)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(ctx, i)
+		}(i)
+	}
+	wg.Wait()
+	return newMultiError(errs...)
+}
+
+// multiError aggregates several errors, such as the ones of the calls made by forEach.
+type multiError []error
+
+// newMultiError returns the non-nil errors among errs as a multiError, nil if there are none, or the only
+// error if there's just one. Errors that are multiErrors themselves are flattened.
+func newMultiError(errs ...error) error {
+	var m multiError
+	for _, err := range errs {
+		switch err := err.(type) {
+		case nil:
+		case multiError:
+			m = append(m, err...)
+		default:
+			m = append(m, err)
+		}
+	}
+	switch len(m) {
+	case 0:
+		return nil
+	case 1:
+		return m[0]
+	}
+	return m
+}
+
+func (m multiError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d errors occurred:", len(m)))
+	for _, err := range m {
+		sb.WriteString("\n\t* ")
+		sb.WriteString(err.Error())
+	}
+	return sb.String()
+}
+
+// Unwrap returns the errors, for errors.Is and errors.As to look into them from Go 1.20.
+func (m multiError) Unwrap() []error {
+	return m
+}
+
+// Is reports whether any of the errors matches target, as errors.Is doesn't use Unwrap() []error before Go 1.20.
+func (m multiError) Is(target error) bool {
+	for _, err := range m {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target, as errors.As doesn't use Unwrap() []error before Go 1.20.
+func (m multiError) As(target any) bool {
+	for _, err := range m {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
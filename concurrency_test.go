@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+func TestMultiErrorIsAs(t *testing.T) {
+	p := &BuildkitePlugin{concurrency: 2}
+	err := p.forEach(context.Background(), 3, func(ctx context.Context, i int) error {
+		switch i {
+		case 0:
+			return fmt.Errorf("failed to read test.log: %w", fs.ErrNotExist)
+		case 2:
+			return &AnalyticsError{StatusCode: 503}
+		}
+		return nil
+	})
+	m, ok := newMultiError(err, errors.New("failed to upload")).(multiError)
+	if !ok || len(m) != 3 {
+		t.Fatalf("newMultiError() = %#v, want the 3 errors flattened", m)
+	}
+	// Go 1.20 and later look into the errors with Unwrap, the versions before rely on the Is and As methods.
+	if !m.Is(fs.ErrNotExist) {
+		t.Errorf("%v.Is(fs.ErrNotExist) = false", m)
+	}
+	var target *AnalyticsError
+	if !m.As(&target) {
+		t.Errorf("%v.As(*AnalyticsError) = false", m)
+	}
+	err = fmt.Errorf("failed to report: %w", m)
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("errors.Is(%v, fs.ErrNotExist) = false", err)
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		t.Errorf("errors.Is(%v, fs.ErrPermission) = true", err)
+	}
+	var apiErr *AnalyticsError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 503 {
+		t.Errorf("errors.As(%v) = %v", err, apiErr)
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		t.Errorf("errors.As(%v) = %v, want no *fs.PathError", err, pathErr)
+	}
+}
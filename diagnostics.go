@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxDiagnostics caps how many diagnostics are listed for a single action, across its outputs, the first ones
+// being the most relevant.
+const maxDiagnostics = 50
+
+// diagnostic is an error reported by a compiler, pointing at a location in the sources.
+type diagnostic struct {
+	file    string
+	line    int
+	column  int
+	message string
+}
+
+var (
+	ansiEscapes = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
+
+	// tscDiagnostic matches "src/app.ts(12,3): error TS2322: message".
+	tscDiagnostic = regexp.MustCompile(`^([^\s():]+)\((\d+),(\d+)\): error (TS\d+: .*)$`)
+	// ccDiagnostic matches clang and gcc, "foo/bar.cc:12:3: error: message".
+	ccDiagnostic = regexp.MustCompile(`^([^\s:]+):(\d+):(\d+): (?:fatal )?error: (.*)$`)
+	// javacDiagnostic matches "foo/Bar.java:12: error: message".
+	javacDiagnostic = regexp.MustCompile(`^([^\s:]+\.java):(\d+): error: (.*)$`)
+	// goDiagnostic matches "foo/bar.go:12:3: message", the column being optional.
+	goDiagnostic = regexp.MustCompile(`^([^\s:]+\.go):(\d+)(?::(\d+))?: (.*)$`)
+	// rustcError matches the first line of rustc errors, "error[E0308]: message", which is only a diagnostic
+	// when the next line is its location, matched by rustcLocation, "  --> src/main.rs:2:5".
+	rustcError    = regexp.MustCompile(`^error(\[E\d+\])?: (.*)$`)
+	rustcLocation = regexp.MustCompile(`^\s*--> ([^\s:]+\.rs):(\d+):(\d+)$`)
+)
+
+// parseDiagnostics extracts the errors reported by the common compilers (Go, javac, clang/gcc, tsc, rustc)
+// from the output of an action.
+func parseDiagnostics(output []byte) []diagnostic {
+	var diags []diagnostic
+	seen := map[diagnostic]bool{}
+	add := func(file, line, column, message string) {
+		d := diagnostic{file: file, message: strings.TrimSpace(message)}
+		d.line, _ = strconv.Atoi(line)
+		d.column, _ = strconv.Atoi(column)
+		if !seen[d] {
+			seen[d] = true
+			diags = append(diags, d)
+		}
+	}
+
+	var rustMessage string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() && len(diags) < maxDiagnostics {
+		line := ansiEscapes.ReplaceAllString(scanner.Text(), "")
+
+		if rustMessage != "" {
+			message := rustMessage
+			rustMessage = ""
+			if m := rustcLocation.FindStringSubmatch(line); m != nil {
+				add(m[1], m[2], m[3], message)
+				continue
+			}
+		}
+		if m := rustcError.FindStringSubmatch(line); m != nil {
+			rustMessage = strings.TrimPrefix(m[1]+" ", " ") + m[2]
+			continue
+		}
+
+		if m := tscDiagnostic.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4])
+		} else if m := ccDiagnostic.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4])
+		} else if m := javacDiagnostic.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], "", m[3])
+		} else if m := goDiagnostic.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2], m[3], m[4])
+		}
+	}
+	return diags
+}
+
+// renderDiagnosticsMarkdown renders the diagnostics as a table, linking to their location in the sources when
+// possible.
+func renderDiagnosticsMarkdown(diags []diagnostic, link func(file string, line int) string) string {
+	if len(diags) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("| Location | Error |\n| --- | --- |\n")
+	for _, d := range diags {
+		location := fmt.Sprintf("%s:%d", d.file, d.line)
+		if d.column > 0 {
+			location += fmt.Sprintf(":%d", d.column)
+		}
+		location = "`" + location + "`"
+		if link != nil {
+			if u := link(d.file, d.line); u != "" {
+				location = fmt.Sprintf("[%s](%s)", location, u)
+			}
+		}
+		message := markdownTableEscaper.Replace(d.message)
+		sb.WriteString(fmt.Sprintf("| %s | %s |\n", location, message))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// markdownTableEscaper escapes text for a table cell, so types such as "std::vector<int>" aren't taken for HTML
+// and pipes don't end the cell.
+var markdownTableEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "|", `\|`)
+
+var scpLikeRepo = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
+// newSourceLinker returns a function building links to a line of a file in the repository, at the given commit,
+// as browsed on the repository host. The repository URL is the one Buildkite clones from, it can use any of
+// the forms git understands. It returns nil if no links can be built.
+func newSourceLinker(repo string, commit string) func(file string, line int) string {
+	if repo == "" || commit == "" || commit == "HEAD" {
+		return nil
+	}
+
+	var host, path string
+	if u, err := url.Parse(repo); err == nil && u.Scheme != "" && u.Host != "" {
+		host, path = u.Hostname(), u.Path
+	} else if m := scpLikeRepo.FindStringSubmatch(repo); m != nil {
+		host, path = m[1], m[2]
+	} else {
+		return nil
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	base := fmt.Sprintf("https://%s/%s", host, path)
+
+	return func(file string, line int) string {
+		file = workspaceRelativePath(file)
+		if file == "" {
+			return ""
+		}
+		switch {
+		case strings.Contains(host, "gitlab"):
+			return fmt.Sprintf("%s/-/blob/%s/%s#L%d", base, commit, file, line)
+		case strings.Contains(host, "bitbucket"):
+			return fmt.Sprintf("%s/src/%s/%s#lines-%d", base, commit, file, line)
+		default:
+			return fmt.Sprintf("%s/blob/%s/%s#L%d", base, commit, file, line)
+		}
+	}
+}
+
+// workspaceRelativePath returns the path of file relative to the root of the repository, or an empty string if
+// the file isn't part of it, e.g. generated files or files from external repositories.
+func workspaceRelativePath(file string) string {
+	// Actions run in the execroot, whose layout is <output base>/execroot/<workspace name>/<workspace files>.
+	if i := strings.Index(file, "/execroot/"); i >= 0 {
+		rest := file[i+len("/execroot/"):]
+		j := strings.Index(rest, "/")
+		if j < 0 {
+			return ""
+		}
+		file = rest[j+1:]
+	}
+	file = strings.TrimPrefix(file, "./")
+	if strings.HasPrefix(file, "/") ||
+		strings.HasPrefix(file, "../") ||
+		strings.HasPrefix(file, "external/") ||
+		strings.HasPrefix(file, "bazel-out/") {
+		return ""
+	}
+	return file
+}
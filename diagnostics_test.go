@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/aspect-cli-plugin-buildkite/bazel/outputfile"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output string
+		want   []diagnostic
+	}{
+		{
+			name:   "go",
+			output: "compilepkg: error running subcommand\nlib/lib.go:12:3: undefined: Foo\nlib/util.go:7: missing return\n",
+			want: []diagnostic{
+				{file: "lib/lib.go", line: 12, column: 3, message: "undefined: Foo"},
+				{file: "lib/util.go", line: 7, message: "missing return"},
+			},
+		},
+		{
+			name:   "clang",
+			output: "In file included from foo/bar.cc:1:\nfoo/bar.h:4:10: fatal error: 'baz.h' file not found\nfoo/bar.cc:12:3: warning: unused variable 'x'\nfoo/bar.cc:20:5: error: no matching function for call to 'f(std::vector<int>)'\n",
+			want: []diagnostic{
+				{file: "foo/bar.h", line: 4, column: 10, message: "'baz.h' file not found"},
+				{file: "foo/bar.cc", line: 20, column: 5, message: "no matching function for call to 'f(std::vector<int>)'"},
+			},
+		},
+		{
+			name:   "javac",
+			output: "src/com/acme/Foo.java:42: error: incompatible types: List<String> cannot be converted to String\n        return names;\n               ^\n",
+			want: []diagnostic{
+				{file: "src/com/acme/Foo.java", line: 42, message: "incompatible types: List<String> cannot be converted to String"},
+			},
+		},
+		{
+			name:   "tsc",
+			output: "src/app.ts(12,3): error TS2322: Type 'string' is not assignable to type 'number'.\n",
+			want: []diagnostic{
+				{file: "src/app.ts", line: 12, column: 3, message: "TS2322: Type 'string' is not assignable to type 'number'."},
+			},
+		},
+		{
+			name:   "rustc",
+			output: "error[E0308]: mismatched types\n  --> src/main.rs:2:5\n   |\nerror: aborting due to previous error\n",
+			want: []diagnostic{
+				{file: "src/main.rs", line: 2, column: 5, message: "[E0308] mismatched types"},
+			},
+		},
+		{
+			name:   "error lines without a rustc location",
+			output: "error: linking with `cc` failed\nnote: some note\n  --> src/main.rs:2:5\nerror: could not compile\n",
+		},
+		{
+			name:   "ansi escapes",
+			output: "\x1b[1mlib/lib.go:12:3: \x1b[31mundefined: Foo\x1b[0m\n",
+			want: []diagnostic{
+				{file: "lib/lib.go", line: 12, column: 3, message: "undefined: Foo"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseDiagnostics([]byte(tc.output)); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("parseDiagnostics() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRenderDiagnosticsMarkdown(t *testing.T) {
+	diags := []diagnostic{
+		{file: "foo/bar.cc", line: 20, column: 5, message: "no match for 'operator|' (std::vector<int> & int)"},
+		{file: "external/lib/lib.h", line: 3, message: "unknown type"},
+	}
+	link := newSourceLinker("git@github.com:acme/app.git", "abc123")
+	got := renderDiagnosticsMarkdown(diags, link)
+	want := "| Location | Error |\n| --- | --- |\n" +
+		"| [`foo/bar.cc:20:5`](https://github.com/acme/app/blob/abc123/foo/bar.cc#L20) | no match for 'operator\\|' (std::vector&lt;int&gt; &amp; int) |\n" +
+		"| `external/lib/lib.h:3` | unknown type |\n\n"
+	if got != want {
+		t.Errorf("renderDiagnosticsMarkdown() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestNewSourceLinker(t *testing.T) {
+	for _, tc := range []struct {
+		repo string
+		file string
+		want string
+	}{
+		{repo: "git@github.com:acme/app.git", file: "lib/lib.go", want: "https://github.com/acme/app/blob/abc123/lib/lib.go#L12"},
+		{repo: "https://github.com/acme/app", file: "./lib/lib.go", want: "https://github.com/acme/app/blob/abc123/lib/lib.go#L12"},
+		{repo: "ssh://git@gitlab.com/acme/group/app.git", file: "lib/lib.go", want: "https://gitlab.com/acme/group/app/-/blob/abc123/lib/lib.go#L12"},
+		{repo: "git@bitbucket.org:acme/app.git", file: "lib/lib.go", want: "https://bitbucket.org/acme/app/src/abc123/lib/lib.go#lines-12"},
+		{
+			repo: "git@github.com:acme/app.git",
+			file: "/home/ci/.cache/bazel/_bazel_ci/0123/execroot/app/lib/lib.go",
+			want: "https://github.com/acme/app/blob/abc123/lib/lib.go#L12",
+		},
+		{repo: "git@github.com:acme/app.git", file: "external/go_sdk/src/fmt/print.go"},
+		{repo: "git@github.com:acme/app.git", file: "bazel-out/k8-fastbuild/bin/lib/gen.go"},
+		{repo: "git@github.com:acme/app.git", file: "/usr/include/stdio.h"},
+	} {
+		t.Run(tc.repo+" "+tc.file, func(t *testing.T) {
+			link := newSourceLinker(tc.repo, "abc123")
+			if link == nil {
+				t.Fatal("newSourceLinker() = nil")
+			}
+			if got := link(tc.file, 12); got != tc.want {
+				t.Errorf("link(%q) = %q, want %q", tc.file, got, tc.want)
+			}
+		})
+	}
+
+	for _, repo := range []string{"", "not a repository"} {
+		if newSourceLinker(repo, "abc123") != nil {
+			t.Errorf("newSourceLinker(%q) != nil, want nil", repo)
+		}
+	}
+	if newSourceLinker("git@github.com:acme/app.git", "HEAD") != nil {
+		t.Error("newSourceLinker() at HEAD != nil, want nil")
+	}
+}
+
+func TestRenderFailedActionCapsDiagnostics(t *testing.T) {
+	var out strings.Builder
+	for i := 1; i <= maxDiagnostics; i++ {
+		out.WriteString(fmt.Sprintf("lib/lib.go:%d:1: undefined: Foo\n", i))
+	}
+	// The cap applies to the action, its stdout and stderr together.
+	dir := t.TempDir()
+	uris := map[string]string{}
+	for _, name := range []string{"stdout", "stderr"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(strings.ReplaceAll(out.String(), "Foo", name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		uris[name] = "file://" + path
+	}
+	client := outputfile.NewClient()
+	defer client.Close()
+
+	fa := &failedAction{label: "//lib:lib", stdoutURI: uris["stdout"], stderrURI: uris["stderr"]}
+	m, err := renderFailedActionMarkdown(context.Background(), client, fa, maxAnnotationSectionSize, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(m, "| `lib/lib.go:"); n != maxDiagnostics {
+		t.Errorf("listed %d diagnostics, want %d", n, maxDiagnostics)
+	}
+}
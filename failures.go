@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"aspect.build/cli/bazel/buildeventstream"
+)
+
+// failureGraph tells apart the root causes of a failed build from the targets that only failed as a consequence,
+// using the root causes Bazel reports as children of the events of failed targets.
+//
+// When a low-level library fails to compile, every target depending on it fails too, burying the actual error
+// under dozens of failures. Only the root causes are worth being annotated prominently.
+type failureGraph struct {
+	// rootCauses are the labels of the targets which failed on their own, in the order they were reported.
+	rootCauses []string
+	// descriptions holds why a root cause failed when it's not because of an action, e.g. analysis failures.
+	descriptions map[string]string
+	// dependents maps each root cause to the targets that failed because of it.
+	dependents map[string][]string
+	// skipped are the labels of the targets that were not built, because of another failure.
+	skipped []string
+	// aborted tells why the build as a whole was aborted, e.g. interrupted or timed out, if it was, with Bazel's
+	// description of it. Only the first reason is kept, as every pending target reports it.
+	aborted            string
+	abortedDescription string
+
+	seen map[string]bool
+}
+
+func (g *failureGraph) init() {
+	if g.seen == nil {
+		g.descriptions = map[string]string{}
+		g.dependents = map[string][]string{}
+		g.seen = map[string]bool{}
+	}
+}
+
+// addRootCause records a label that failed on its own, with an optional description of why.
+func (g *failureGraph) addRootCause(label string, description string) {
+	g.init()
+	if description != "" && g.descriptions[label] == "" {
+		g.descriptions[label] = description
+	}
+	if g.seen["root:"+label] {
+		return
+	}
+	g.seen["root:"+label] = true
+	g.rootCauses = append(g.rootCauses, label)
+}
+
+// addFailedTarget records a failed target and the root causes of its failure. A target without root causes, or
+// among its own root causes, failed on its own.
+func (g *failureGraph) addFailedTarget(label string, causes []string) {
+	g.init()
+	if len(causes) == 0 {
+		g.addRootCause(label, "")
+		return
+	}
+	for _, cause := range causes {
+		g.addRootCause(cause, "")
+		if cause == label || g.seen["dependent:"+cause+":"+label] {
+			continue
+		}
+		g.seen["dependent:"+cause+":"+label] = true
+		g.dependents[cause] = append(g.dependents[cause], label)
+	}
+}
+
+// addSkipped records a target that wasn't built because of another failure.
+func (g *failureGraph) addSkipped(label string) {
+	g.init()
+	if g.seen["skipped:"+label] {
+		return
+	}
+	g.seen["skipped:"+label] = true
+	g.skipped = append(g.skipped, label)
+}
+
+// setAborted records why the build was aborted, unless it already was.
+func (g *failureGraph) setAborted(reason string, description string) {
+	if g.aborted != "" {
+		return
+	}
+	g.aborted = reason
+	g.abortedDescription = description
+}
+
+// recordFailureEvent updates the failure graph with the events that tell about failures: failed actions and
+// targets, as well as aborted ones.
+func (p *BuildkitePlugin) recordFailureEvent(event *buildeventstream.BuildEvent) {
+	switch event.Payload.(type) {
+	case *buildeventstream.BuildEvent_Action:
+		if !event.GetAction().GetSuccess() {
+			p.failures.addRootCause(event.GetId().GetActionCompleted().GetLabel(), "")
+		}
+
+	case *buildeventstream.BuildEvent_Completed:
+		if event.GetCompleted().GetSuccess() {
+			return
+		}
+		var causes []string
+		for _, child := range event.GetChildren() {
+			if label := eventLabel(child); label != "" {
+				causes = append(causes, label)
+			}
+		}
+		p.failures.addFailedTarget(event.GetId().GetTargetCompleted().GetLabel(), causes)
+
+	case *buildeventstream.BuildEvent_Aborted:
+		aborted := event.GetAborted()
+		switch aborted.GetReason() {
+		case buildeventstream.Aborted_NO_BUILD, buildeventstream.Aborted_NO_ANALYZE, buildeventstream.Aborted_SKIPPED:
+			// Not a failure, Bazel was asked not to build or analyze, or the target is incompatible with
+			// the platform.
+			return
+		case buildeventstream.Aborted_USER_INTERRUPTED:
+			p.failures.setAborted("The build was interrupted", aborted.GetDescription())
+			return
+		case buildeventstream.Aborted_TIME_OUT:
+			p.failures.setAborted("The build timed out", aborted.GetDescription())
+			return
+		case buildeventstream.Aborted_OUT_OF_MEMORY:
+			p.failures.setAborted("Bazel ran out of memory", aborted.GetDescription())
+			return
+		case buildeventstream.Aborted_REMOTE_ENVIRONMENT_FAILURE:
+			p.failures.setAborted("The remote execution environment failed", aborted.GetDescription())
+			return
+		case buildeventstream.Aborted_LOADING_FAILURE, buildeventstream.Aborted_ANALYSIS_FAILURE,
+			buildeventstream.Aborted_INCOMPLETE:
+		default:
+			p.failures.setAborted("The build was aborted", aborted.GetDescription())
+			return
+		}
+
+		label := eventLabel(event.GetId())
+		if label == "" {
+			label = event.GetId().GetTargetCompleted().GetLabel()
+		}
+		if label == "" {
+			label = event.GetId().GetTargetConfigured().GetLabel()
+		}
+		if label == "" {
+			return
+		}
+		if aborted.GetReason() == buildeventstream.Aborted_INCOMPLETE {
+			p.failures.addSkipped(label)
+		} else {
+			p.failures.addRootCause(label, aborted.GetDescription())
+		}
+	}
+}
+
+// eventLabel returns the label of the root cause designated by the given event ID, or an empty string if it
+// doesn't designate one.
+func eventLabel(id *buildeventstream.BuildEventId) string {
+	if label := id.GetActionCompleted().GetLabel(); label != "" {
+		return label
+	}
+	if label := id.GetConfiguredLabel().GetLabel(); label != "" {
+		return label
+	}
+	return id.GetUnconfiguredLabel().GetLabel()
+}
+
+// renderDependentsMarkdown renders the collapsed list of targets that failed because of the given root cause.
+func renderDependentsMarkdown(label string, dependents []string) string {
+	if len(dependents) == 0 {
+		return ""
+	}
+	return renderCollapsedLabels(fmt.Sprintf("%s failed because of <code>%s</code>", pluralize(len(dependents), "target", "targets"), label), dependents)
+}
+
+// renderFailedTargetMarkdown renders a root cause that is not a failed action, such as a target that could not
+// be analyzed.
+func renderFailedTargetMarkdown(label string, description string, dependents []string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("**Target failed: `%s`**\n", label))
+	if description != "" {
+		sb.WriteString("```term\n")
+		sb.WriteString(description)
+		sb.WriteString("\n```\n")
+	}
+	sb.WriteString(renderDependentsMarkdown(label, dependents))
+	return sb.String()
+}
+
+// renderSkippedTargetsMarkdown renders the collapsed list of targets that were not built.
+func renderSkippedTargetsMarkdown(skipped []string) string {
+	if len(skipped) == 0 {
+		return ""
+	}
+	verb := "were"
+	if len(skipped) == 1 {
+		verb = "was"
+	}
+	return renderCollapsedLabels(fmt.Sprintf("%s %s skipped because of the failures above", pluralize(len(skipped), "target", "targets"), verb), skipped)
+}
+
+// renderAbortedMarkdown renders why the build was aborted, if it was.
+func renderAbortedMarkdown(reason string, description string) string {
+	if reason == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("**%s.** The targets which were still pending are not listed.\n", reason))
+	if description != "" {
+		sb.WriteString("```term\n")
+		sb.WriteString(description)
+		sb.WriteString("\n```\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// pluralize returns n followed by singular or plural, depending on n.
+func pluralize(n int, singular string, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
+func renderCollapsedLabels(summary string, labels []string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("\n<details><summary>%s</summary>\n\n", summary))
+	for _, label := range labels {
+		sb.WriteString(fmt.Sprintf("- `%s`\n", label))
+	}
+	sb.WriteString("\n</details>\n\n")
+	return sb.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"aspect.build/cli/bazel/buildeventstream"
+)
+
+// flakyTest is a test target that failed at first, but passed once retried by Bazel (see --flaky_test_attempts).
+type flakyTest struct {
+	label string
+	// attempts is the number of attempts it took to pass.
+	attempts int32
+	// failedLogs are the test.log of the attempts that failed.
+	failedLogs []*buildeventstream.File
+}
+
+// isFlaky returns true if the test target with the given label has been reported as flaky.
+func (p *BuildkitePlugin) isFlaky(label string) bool {
+	for _, ft := range p.flakyTests {
+		if ft.label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// annotateFlakyTests posts a warning annotation listing the flaky tests, with links to the logs
+// of their failed attempts.
+func (p *BuildkitePlugin) annotateFlakyTests(ctx context.Context) error {
+	if len(p.flakyTests) == 0 {
+		return nil
+	}
+
+	entries := make([]string, len(p.flakyTests))
+	err := p.forEach(ctx, len(p.flakyTests), func(ctx context.Context, i int) error {
+		m, err := p.renderFlakyTest(ctx, p.flakyTests[i])
+		if err != nil {
+			return fmt.Errorf("failed to report %s: %w", p.flakyTests[i].label, err)
+		}
+		entries[i] = m
+		return nil
+	})
+
+	var sb strings.Builder
+	sb.WriteString("#### Flaky tests\n\n")
+	sb.WriteString(fmt.Sprintf("[Jump to job.](#%s)\n\n", p.buildkiteJobID))
+	sb.WriteString("The following test targets failed at first, but passed when retried:\n\n")
+	for _, m := range entries {
+		sb.WriteString(m)
+	}
+	return newMultiError(err, p.annotate(ctx, "warning", fmt.Sprintf("flaky_tests_%s", p.buildkiteJobID), []byte(sb.String())))
+}
+
+// renderFlakyTest uploads the logs of the failed attempts of a flaky test, and renders its entry in the list of
+// flaky tests, linking to them.
+func (p *BuildkitePlugin) renderFlakyTest(ctx context.Context, ft *flakyTest) (string, error) {
+	var links []string
+	for i, f := range ft.failedLogs {
+		if f.GetUri() == "" {
+			continue
+		}
+		relPath := path.Join(labelPath(ft.label), fmt.Sprintf("failed_attempt_%d", i+1), f.GetName())
+		localPath, err := p.fetchOutput(ctx, f.GetUri(), relPath)
+		if err != nil {
+			return "", err
+		}
+		artifactPath, err := p.uploadArtifact(ctx, localPath, relPath)
+		if err != nil {
+			return "", err
+		}
+		links = append(links, fmt.Sprintf("[failed attempt %d](artifact://%s)", i+1, artifactPath))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("- `%s`", ft.label))
+	if ft.attempts > 1 {
+		sb.WriteString(fmt.Sprintf(" passed after %d attempts", ft.attempts))
+	}
+	if len(links) > 0 {
+		sb.WriteString(" (" + strings.Join(links, ", ") + ")")
+	}
+	sb.WriteString("\n")
+	return sb.String(), nil
+}
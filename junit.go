@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// junitTestSuite is a <testsuite> element of the JUnit XML reports written by Bazel test runners in test.xml.
+// Test suites can be nested, and the root of the document can be either a <testsuites> or a <testsuite>.
+type junitTestSuite struct {
+	Name      string           `xml:"name,attr"`
+	Suites    []junitTestSuite `xml:"testsuite"`
+	TestCases []junitTestCase  `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *junitFailure `xml:"skipped"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// parseJUnitXML reads all test cases from the JUnit XML report at path.
+func parseJUnitXML(path string) ([]junitTestCase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := xml.NewDecoder(f)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		// Both <testsuites> and <testsuite> roots have the same shape as far as we're concerned,
+		// they can contain test suites and test cases.
+		var root junitTestSuite
+		if err := dec.DecodeElement(&root, &start); err != nil {
+			return nil, err
+		}
+		return root.allTestCases(), nil
+	}
+}
+
+func (s *junitTestSuite) allTestCases() []junitTestCase {
+	cases := s.TestCases
+	for i := range s.Suites {
+		cases = append(cases, s.Suites[i].allTestCases()...)
+	}
+	return cases
+}
+
+// durationInSec parses the time attribute of a test case, which some runners format with thousands separators.
+func (tc *junitTestCase) durationInSec() float64 {
+	d, err := strconv.ParseFloat(strings.ReplaceAll(tc.Time, ",", ""), 64)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// TestCasePayloads returns one analytics payload per test case found in the JUnit XML report at testXMLPath, scoped
+// under the target label, qualified by the shard and attempt that ran them. It returns no payloads if the report
+// doesn't have any test cases.
+func (tr *testResultInfo) TestCasePayloads(labelPrefix string, testXMLPath string) ([]*AnalyticsTestPayload, error) {
+	cases, err := parseJUnitXML(testXMLPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", testXMLPath, err)
+	}
+
+	payloads := make([]*AnalyticsTestPayload, 0, len(cases))
+	for _, tc := range cases {
+		name := tc.Name
+		if tc.ClassName != "" {
+			name = tc.ClassName + "." + tc.Name
+		}
+
+		result := "passed"
+		failureExpanded := []map[string][]string{}
+		var failureReason *string
+		failure := tc.Failure
+		if failure == nil {
+			failure = tc.Error
+		}
+		if failure != nil {
+			result = "failed"
+			reason := failure.Message
+			if reason == "" {
+				reason = failure.Type
+			}
+			failureReason = &reason
+			if body := strings.TrimSpace(failure.Body); body != "" {
+				failureExpanded = append(failureExpanded, map[string][]string{"expanded": strings.Split(body, "\n")})
+			}
+		} else if tc.Skipped != nil {
+			result = "skipped"
+		}
+
+		duration := tc.durationInSec()
+		startAt := tr.result.GetTestAttemptStartMillisEpoch()
+		payloads = append(payloads, &AnalyticsTestPayload{
+			ID:              uuid.NewString(),
+			Scope:           labelPrefix + tr.Name(),
+			Name:            name,
+			FileName:        tc.File,
+			Result:          result,
+			FailureReason:   failureReason,
+			FailureExpanded: failureExpanded,
+			History: History{
+				StartAt:       startAt,
+				EndAt:         startAt + int64(duration*1000),
+				DurationInSec: duration,
+			},
+		})
+	}
+	return payloads, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"aspect.build/cli/bazel/buildeventstream"
+)
+
+// defaultMetaDataKeyPrefix is what the keys of the build meta-data are prefixed with, unless configured otherwise.
+const defaultMetaDataKeyPrefix = "bazel."
+
+// buildStats counts the outcomes of the targets of a build, to be published as build meta-data.
+type buildStats struct {
+	// invocationID is the ID Bazel gave to the invocation, as reported when the build started.
+	invocationID string
+	// targetsBuilt is the number of targets that were built successfully, tests included.
+	targetsBuilt int
+	// testsPassed, testsFailed and testsFlaky count the test targets by their overall status.
+	testsPassed int
+	testsFailed int
+	testsFlaky  int
+	// testsCached is the number of test targets whose results all came from a cache.
+	testsCached int
+}
+
+// recordStats updates the build statistics with the events that tell about the outcome of the targets.
+func (p *BuildkitePlugin) recordStats(event *buildeventstream.BuildEvent) {
+	switch event.Payload.(type) {
+	case *buildeventstream.BuildEvent_Started:
+		p.stats.invocationID = event.GetStarted().GetUuid()
+
+	case *buildeventstream.BuildEvent_Completed:
+		if event.GetCompleted().GetSuccess() {
+			p.stats.targetsBuilt++
+		}
+
+	case *buildeventstream.BuildEvent_TestSummary:
+		summary := event.GetTestSummary()
+		switch status := summary.GetOverallStatus(); {
+		case status == buildeventstream.TestStatus_PASSED:
+			p.stats.testsPassed++
+		case status == buildeventstream.TestStatus_FLAKY:
+			p.stats.testsFlaky++
+		case isFailedTestStatus(status):
+			p.stats.testsFailed++
+		}
+		if cached := summary.GetTotalNumCached(); cached > 0 && cached >= summary.GetTotalRunCount() {
+			p.stats.testsCached++
+		}
+	}
+}
+
+// failedLabels returns the labels of the test targets that failed, followed by the ones of the targets that failed
+// to build on their own, without duplicates.
+func (p *BuildkitePlugin) failedLabels() []string {
+	labels := p.failedTestLabels()
+	seen := map[string]bool{}
+	for _, label := range labels {
+		seen[label] = true
+	}
+	for _, label := range p.failures.rootCauses {
+		if !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// setBuildMetaData publishes the build statistics as meta-data of the Buildkite build, so the steps running after
+// this one can read them with buildkite-agent meta-data get. Failed labels are separated by newlines.
+func (p *BuildkitePlugin) setBuildMetaData(ctx context.Context) error {
+	values := []struct {
+		key   string
+		value string
+	}{
+		{"invocation_id", p.stats.invocationID},
+		{"targets_built", strconv.Itoa(p.stats.targetsBuilt)},
+		{"tests_passed", strconv.Itoa(p.stats.testsPassed)},
+		{"tests_failed", strconv.Itoa(p.stats.testsFailed)},
+		{"tests_flaky", strconv.Itoa(p.stats.testsFlaky)},
+		{"tests_cached", strconv.Itoa(p.stats.testsCached)},
+		{"failed_labels", strings.Join(p.failedLabels(), "\n")},
+	}
+
+	var errs []error
+	for _, v := range values {
+		// Buildkite rejects empty values, leave the key unset instead.
+		if v.value == "" {
+			continue
+		}
+		if err := p.agent.MetaDataSet(ctx, p.metaDataKeyPrefix+v.key, v.value); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set meta-data %s: %w", p.metaDataKeyPrefix+v.key, err))
+		}
+	}
+	return newMultiError(errs...)
+}
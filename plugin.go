@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/google/uuid"
 	goplugin "github.com/hashicorp/go-plugin"
@@ -40,6 +43,13 @@ type BuildkitePlugin struct {
 	// testResultInfos is a list of failed tests whose logs will be uploaded as artifacts.
 	testResultInfos []*testResultInfo
 
+	// flakyTests is a list of tests that failed at first but passed when retried, which are reported
+	// separately from the failed ones.
+	flakyTests []*flakyTest
+
+	// failures tells apart the root causes of the failures from the targets that failed because of them.
+	failures failureGraph
+
 	// failedActions is a list of actions that did not succeed, whose output will be used to annotate
 	// the build for more clarity.
 	failedActions []*failedAction
@@ -48,6 +58,9 @@ type BuildkitePlugin struct {
 	// the token from or defaults to read it from "$BUILDKITE_ANALYTICS_TOKEN".
 	buildkiteAnalyticsToken string
 
+	// buildkiteAnalyticsURL is the base URL of the Test Analytics API results are uploaded to.
+	buildkiteAnalyticsURL string
+
 	// junitXMLBuildkiteAnalyticsToken is the analytics token for JUnit XML
 	// uploads. A seperate token since this is more detailed/verbose results.
 	junitXMLBuildkiteAnalyticsToken string
@@ -55,6 +68,16 @@ type BuildkitePlugin struct {
 	// annotationsEnabled determines whether we should post annotations or not
 	annotationsEnabled bool
 
+	// metaDataEnabled determines whether the build statistics are published as build meta-data.
+	metaDataEnabled bool
+	// metaDataKeyPrefix is what the keys of the build meta-data are prefixed with.
+	metaDataKeyPrefix string
+	// stats counts the outcomes of the targets, to be published as build meta-data.
+	stats buildStats
+
+	// retryStep configures the step uploaded to retry the failed tests. It is nil if retrying is disabled.
+	retryStep *retryStep
+
 	// isPreamblePosted tells us if we have posted or not the preamble, as we don't have
 	// a final or first hook to run things before or after the completion of the entire build.
 	isPreamblePosted bool
@@ -71,6 +94,43 @@ type BuildkitePlugin struct {
 
 	// dryRun when enabled will let the plugin not post to actual apis instead write results locally
 	dryRun bool
+
+	// annotationPreviewDir is where the annotations are rendered as HTML pages in dry-run mode.
+	annotationPreviewDir string
+
+	// testLogLines is how many lines from the end of test.log are included in the annotation of a failed test.
+	testLogLines int
+
+	// annotationBudget tracks the size of each annotation context, to stay under the limits of Buildkite.
+	annotationBudget *annotationBudget
+
+	// artifactsParentDir is where the scratch directory is created, the system temporary directory if empty.
+	artifactsParentDir string
+
+	// scratchDir is the directory of this invocation where outputs are downloaded before being uploaded as
+	// artifacts, created on first use and removed once the hook completes, see artifactsDir.
+	scratchDir string
+
+	// downloadCacheDir is where the outputs fetched from a remote cache are kept across invocations. If empty,
+	// they are only kept for the duration of the invocation, in the scratch directory.
+	downloadCacheDir string
+	// downloadCacheMaxAge is how long the outputs kept in downloadCacheDir can go unused before being removed.
+	// Zero disables pruning.
+	downloadCacheMaxAge time.Duration
+
+	// testPreamble is the template rendered at the top of the failed tests annotation.
+	testPreamble *template.Template
+
+	// remoteCredentials are the credentials configured in the plugin properties to fetch outputs from a remote
+	// cache, which take precedence over the ones found in the Bazel flags.
+	remoteCredentials *outputfile.Credentials
+
+	// concurrency is how many outputs are fetched and uploaded at once.
+	concurrency int
+
+	// sourceLinker builds links to the sources of the repository being built, at the commit being built.
+	// It is nil if they can't be built.
+	sourceLinker func(file string, line int) string
 }
 
 type pluginProperties struct {
@@ -83,10 +143,18 @@ type pluginProperties struct {
 	// of executing them, useful for local development.
 	Pretend bool `yaml:"pretend"`
 
+	// AnnotationPreviewDir is where pretend mode renders each annotation context as an HTML page, styled like
+	// the Buildkite UI. Defaults to buildkite-annotations in the system temporary directory.
+	AnnotationPreviewDir string `yaml:"annotation_preview_dir"`
+
 	// BuildkiteAnalyticsTokenName is the name of the env var we should be reading
 	// the token from. The default env var name is "BUILDKITE_ANALYTICS_TOKEN".
 	BuildkiteAnalyticsTokenName string `yaml:"buildkite_analytics_env_name"`
 
+	// BuildkiteAnalyticsURL is the base URL of the Test Analytics API, which can be pointed at a proxy or
+	// a local collector. Defaults to DefaultAnalyticsURL.
+	BuildkiteAnalyticsURL string `yaml:"buildkite_analytics_url"`
+
 	// JUnitXMLBuildkiteAnalyticsTokenName is the name of the env var we should
 	// be reading the token from for JUnit XML uploads.
 	JUnitXMLBuildkiteAnalyticsTokenName string `yaml:"junit_xml_buildkite_analytics_env_name"`
@@ -94,25 +162,157 @@ type pluginProperties struct {
 	// EnableAnnotations enables whether we should post annotations or not
 	EnableAnnotations bool `yaml:"enable_annotations"`
 
+	// EnableMetaData enables publishing the outcome of the build as meta-data of the Buildkite build, which later
+	// steps can read: the invocation ID, how many targets were built, how many tests passed, failed, were flaky
+	// or cached, and the labels of the failed targets.
+	EnableMetaData bool `yaml:"enable_metadata"`
+
+	// MetaDataKeyPrefix is what the meta-data keys are prefixed with, expanded with environment variables so jobs
+	// can use distinct keys, e.g. "bazel.$BUILDKITE_STEP_KEY.". Defaults to "bazel.".
+	MetaDataKeyPrefix string `yaml:"metadata_key_prefix"`
+
 	// JUnitXMLTargets is a list of test targets that should have their JUnit XML uploaded
 	JUnitXMLTargets []string `yaml:"junit_xml_targets"`
+
+	// TestLogLines is how many lines from the end of the test.log of a failed test are inlined
+	// in its annotation. Defaults to 50, a negative value disables the excerpt.
+	TestLogLines int `yaml:"test_log_lines"`
+
+	// TestPreamble is a Go text/template rendered at the top of the failed tests annotation, see
+	// testPreambleData for the available fields. Defaults to defaultTestPreamble.
+	TestPreamble string `yaml:"test_preamble"`
+
+	// TestPreambleFile is the path to a file containing the TestPreamble template. Takes precedence
+	// over TestPreamble.
+	TestPreambleFile string `yaml:"test_preamble_file"`
+
+	// ArtifactsDir is the directory under which the scratch directory of each invocation is created, to hold
+	// the downloaded outputs and the files to upload. Defaults to the system temporary directory.
+	ArtifactsDir string `yaml:"artifacts_dir"`
+
+	// DownloadCacheDir is a directory where the outputs fetched from a remote cache are kept, indexed by their
+	// digest, so they are not downloaded again by the next invocations on the same agent. Defaults to caching
+	// them for the duration of the invocation only.
+	DownloadCacheDir string `yaml:"download_cache_dir"`
+
+	// DownloadCacheMaxAge is how long the outputs kept in DownloadCacheDir can go unused before they are removed
+	// from it, as a Go duration, e.g. "72h". Defaults to a week, and "0" disables pruning.
+	DownloadCacheMaxAge string `yaml:"download_cache_max_age"`
+
+	// Concurrency is how many outputs are fetched, and uploaded as artifacts, at once. Defaults to 8.
+	Concurrency int `yaml:"concurrency"`
+
+	// Retry configures a step uploaded to the pipeline when tests fail, running only the failed test targets
+	// again, see retryProperties. Disabled by default.
+	Retry retryProperties `yaml:"retry"`
+
+	// Remote configures how outputs stored in a remote cache are fetched. By default, the plugin uses
+	// the same settings as Bazel, as found in its flags.
+	Remote remoteProperties `yaml:"remote"`
+}
+
+// remoteProperties mirrors the Bazel flags of the same names, see outputfile.Credentials.
+type remoteProperties struct {
+	TLS                  bool   `yaml:"tls"`
+	TLSCertificate       string `yaml:"tls_certificate"`
+	TLSClientCertificate string `yaml:"tls_client_certificate"`
+	TLSClientKey         string `yaml:"tls_client_key"`
+	// Endpoints are the remote cache and executor URLs, in addition to the ones Bazel was given, which Headers
+	// are sent to.
+	Endpoints []string `yaml:"endpoints"`
+	// Headers are sent along the requests to the endpoints. Values are expanded with environment variables, so secrets
+	// don't have to be written in the configuration.
+	Headers map[string]string `yaml:"headers"`
+	// CredentialHelpers are in the same "[scope=]path" form as the values of --credential_helper.
+	CredentialHelpers []string `yaml:"credential_helpers"`
+}
+
+func (r *remoteProperties) credentials() *outputfile.Credentials {
+	creds := &outputfile.Credentials{
+		TLS:                  r.TLS,
+		TLSCertificate:       r.TLSCertificate,
+		TLSClientCertificate: r.TLSClientCertificate,
+		TLSClientKey:         r.TLSClientKey,
+		Headers:              map[string][]string{},
+	}
+	for _, e := range r.Endpoints {
+		creds.AddEndpoint(e)
+	}
+	for k, v := range r.Headers {
+		creds.Headers[k] = []string{os.ExpandEnv(v)}
+	}
+	for _, h := range r.CredentialHelpers {
+		creds.CredentialHelpers = append(creds.CredentialHelpers, outputfile.ParseCredentialHelper(h))
+	}
+	return creds
 }
 
+// defaultTestLogLines is the number of lines of test.log inlined in failed test annotations, unless configured
+// otherwise.
+const defaultTestLogLines = 50
+
 // failedAction is small struct to hold the results from a failed action.
 type failedAction struct {
 	label     string
+	mnemonic  string
 	stderrURI string
 	stdoutURI string
+
+	// index is the 1-based position of the action among the failed actions of its target.
+	index int
 }
 
 type testResultInfo struct {
 	result *buildeventstream.TestResult
 	label  string
 	cached bool
+
+	// run, shard and attempt identify which execution of the test target this result is about, they
+	// are 1-based and 0 when Bazel did not report them.
+	run     int32
+	shard   int32
+	attempt int32
+
+	// summary is the summary of the test target, once reported, which tells the final status of the target
+	// across all of its runs, shards and attempts.
+	summary *buildeventstream.TestSummary
 }
 
+// Name returns the label of the test target, qualified by the shard, run and attempt of this result when
+// the target had more than one, so each of them can be told apart.
+func (tr *testResultInfo) Name() string {
+	var qualifiers []string
+	if n := tr.summary.GetShardCount(); n > 1 {
+		qualifiers = append(qualifiers, fmt.Sprintf("shard %d/%d", tr.shard, n))
+	}
+	if n := tr.summary.GetRunCount(); n > 1 {
+		qualifiers = append(qualifiers, fmt.Sprintf("run %d/%d", tr.run, n))
+	}
+	if tr.attempt > 1 || tr.summary.GetAttemptCount() > 1 {
+		qualifiers = append(qualifiers, fmt.Sprintf("attempt %d", tr.attempt))
+	}
+	if len(qualifiers) == 0 {
+		return tr.label
+	}
+	return fmt.Sprintf("%s (%s)", tr.label, strings.Join(qualifiers, ", "))
+}
+
+// TargetFailed returns true if the test target failed as a whole, according to its summary. If the summary
+// hasn't been reported, the status of this result is used instead.
+func (tr *testResultInfo) TargetFailed() bool {
+	if tr.summary == nil {
+		return tr.Failed()
+	}
+	return isFailedTestStatus(tr.summary.GetOverallStatus())
+}
+
+// Failed returns true if this test attempt failed. The target itself may still have passed if it was
+// retried, see flakyTest.
 func (tr *testResultInfo) Failed() bool {
-	status := tr.result.GetStatus()
+	return isFailedTestStatus(tr.result.GetStatus())
+}
+
+func isFailedTestStatus(status buildeventstream.TestStatus) bool {
 	return status == buildeventstream.TestStatus_FAILED ||
 		status == buildeventstream.TestStatus_REMOTE_FAILURE ||
 		status == buildeventstream.TestStatus_TIMEOUT
@@ -175,7 +375,7 @@ func (tr *testResultInfo) AnalyticsPayload(labelPrefix string, testLogPath strin
 
 	return &AnalyticsTestPayload{
 		ID:              uuid.NewString(),
-		Name:            labelPrefix + tr.label,
+		Name:            labelPrefix + tr.Name(),
 		Result:          result,
 		FailureReason:   failureReason,
 		FailureExpanded: failureExpanded,
@@ -200,6 +400,11 @@ func (p *BuildkitePlugin) Setup(config *aspectplugin.SetupConfig) error {
 	}
 
 	p.annotationsEnabled = props.EnableAnnotations
+	p.metaDataEnabled = props.EnableMetaData
+	p.metaDataKeyPrefix = os.ExpandEnv(props.MetaDataKeyPrefix)
+	if p.metaDataKeyPrefix == "" {
+		p.metaDataKeyPrefix = defaultMetaDataKeyPrefix
+	}
 
 	// Read the BuildkiteAnalytics token from the env.
 	tokvar := props.BuildkiteAnalyticsTokenName
@@ -208,6 +413,11 @@ func (p *BuildkitePlugin) Setup(config *aspectplugin.SetupConfig) error {
 	}
 	p.buildkiteAnalyticsToken = os.Getenv(tokvar)
 
+	p.buildkiteAnalyticsURL = props.BuildkiteAnalyticsURL
+	if p.buildkiteAnalyticsURL == "" {
+		p.buildkiteAnalyticsURL = DefaultAnalyticsURL
+	}
+
 	// Read the BuildkiteAnalytics token for JUnitXML from the env.
 	if envvar := props.JUnitXMLBuildkiteAnalyticsTokenName; envvar != "" {
 		p.junitXMLBuildkiteAnalyticsToken = os.Getenv(envvar)
@@ -216,11 +426,14 @@ func (p *BuildkitePlugin) Setup(config *aspectplugin.SetupConfig) error {
 	// Read the Buildkite Job ID
 	p.buildkiteJobID = os.Getenv("BUILDKITE_JOB_ID")
 
+	// Link compiler errors to the sources being built.
+	p.sourceLinker = newSourceLinker(os.Getenv("BUILDKITE_REPO"), os.Getenv("BUILDKITE_COMMIT"))
+
 	// Prepare buildkiteagent that we use to interact with Buildkite
 	if !props.Pretend {
 		p.agent = NewBuildkiteAgent(props.BuildkiteAgentPath)
 	} else {
-		p.agent = NewMockBuildkiteAgent(props.BuildkiteAgentPath)
+		p.agent = NewMockBuildkiteAgent(props.BuildkiteAgentPath, props.AnnotationPreviewDir)
 		p.dryRun = true
 	}
 
@@ -230,8 +443,46 @@ func (p *BuildkitePlugin) Setup(config *aspectplugin.SetupConfig) error {
 	// Set the JUnit XML targets
 	p.junitXMLTargets = props.JUnitXMLTargets
 
+	p.testLogLines = props.TestLogLines
+	if p.testLogLines == 0 {
+		p.testLogLines = defaultTestLogLines
+	}
+
+	p.concurrency = props.Concurrency
+	if p.concurrency <= 0 {
+		p.concurrency = defaultConcurrency
+	}
+
+	p.annotationPreviewDir = props.AnnotationPreviewDir
+	p.annotationBudget = newAnnotationBudget(maxAnnotationSize)
+	p.artifactsParentDir = props.ArtifactsDir
+
+	preamble, err := parseTestPreamble(props.TestPreamble, props.TestPreambleFile)
+	if err != nil {
+		return fmt.Errorf("failed to setup: %w", err)
+	}
+	p.testPreamble = preamble
+
+	retry, err := newRetryStep(props.Retry)
+	if err != nil {
+		return fmt.Errorf("failed to setup: %w", err)
+	}
+	p.retryStep = retry
+
 	// Create a client to read URIs, as they can be files or bytestream if a remote-cache is enabled.
 	p.outputClient = outputfile.NewClient()
+	p.remoteCredentials = props.Remote.credentials()
+	p.outputClient.SetCredentials(p.remoteCredentials)
+	p.downloadCacheDir = props.DownloadCacheDir
+	p.outputClient.SetCacheDir(p.downloadCacheDir)
+	p.downloadCacheMaxAge = defaultDownloadCacheMaxAge
+	if props.DownloadCacheMaxAge != "" {
+		maxAge, err := time.ParseDuration(props.DownloadCacheMaxAge)
+		if err != nil {
+			return fmt.Errorf("failed to setup: invalid download_cache_max_age: %w", err)
+		}
+		p.downloadCacheMaxAge = maxAge
+	}
 
 	return nil
 }
@@ -262,28 +513,66 @@ func (p *BuildkitePlugin) BEPEventCallback(event *buildeventstream.BuildEvent) e
 	switch event.Payload.(type) {
 	case *buildeventstream.BuildEvent_TestResult:
 		testResult := event.GetTestResult()
-		label := event.Id.GetTestResult().GetLabel()
+		id := event.Id.GetTestResult()
+		label := id.GetLabel()
 
 		tr := testResultInfo{
-			result: testResult,
-			label:  label,
-			cached: testResult.GetCachedLocally() || testResult.GetExecutionInfo().GetCachedRemotely(),
+			result:  testResult,
+			label:   label,
+			cached:  testResult.GetCachedLocally() || testResult.GetExecutionInfo().GetCachedRemotely(),
+			run:     id.GetRun(),
+			shard:   id.GetShard(),
+			attempt: id.GetAttempt(),
 		}
 
 		if !tr.cached {
 			p.testResultInfos = append(p.testResultInfos, &tr)
 		}
 
+	case *buildeventstream.BuildEvent_TestSummary:
+		summary := event.GetTestSummary()
+		label := event.Id.GetTestSummary().GetLabel()
+		// The summary is posted once all results of the target have been, attach it to them.
+		for _, tr := range p.testResultInfos {
+			if tr.label == label {
+				tr.summary = summary
+			}
+		}
+		// Bazel only reports a target as flaky in its summary, its attempts are reported as failed or passed.
+		if summary.GetOverallStatus() == buildeventstream.TestStatus_FLAKY {
+			p.flakyTests = append(p.flakyTests, &flakyTest{
+				label:      label,
+				attempts:   summary.GetAttemptCount(),
+				failedLogs: summary.GetFailed(),
+			})
+		}
+
+	case *buildeventstream.BuildEvent_OptionsParsed:
+		// Fetch remote outputs the same way Bazel stored them, unless configured otherwise.
+		creds := outputfile.ParseBazelFlags(event.GetOptionsParsed().GetCmdLine())
+		creds.Merge(p.remoteCredentials)
+		p.outputClient.SetCredentials(creds)
+
 	case *buildeventstream.BuildEvent_Action:
 		action := event.GetAction()
 		if !action.GetSuccess() {
-			p.failedActions = append(p.failedActions, &failedAction{
+			fa := &failedAction{
 				label:     event.GetId().GetActionCompleted().GetLabel(),
+				mnemonic:  action.GetType(),
 				stderrURI: action.GetStderr().GetUri(),
 				stdoutURI: action.GetStdout().GetUri(),
-			})
+				index:     1,
+			}
+			for _, other := range p.failedActions {
+				if other.label == fa.label {
+					fa.index++
+				}
+			}
+			p.failedActions = append(p.failedActions, fa)
 		}
 	}
+	p.recordFailureEvent(event)
+	p.recordStats(event)
 	return nil
 }
 
@@ -307,166 +596,486 @@ func (p *BuildkitePlugin) hook(_ bool, pr ioutils.PromptRunner) error {
 		defer fmt.Println("--- Dry run [ END ] ---")
 	}
 
+	// Everything has been uploaded once we're done, downloaded outputs are not needed anymore.
+	defer p.cleanupArtifacts()
+	defer p.pruneDownloadCache()
+	// Create it upfront, so outputs are cached even when they are read without being downloaded at a given path.
+	if _, err := p.artifactsDir(); err != nil {
+		return err
+	}
+
+	// A failure to report something shouldn't prevent reporting the rest.
 	ctx := context.Background()
+	var errs []error
 	if p.annotationsEnabled {
-		if err := p.annotateFailedTests(ctx); err != nil {
-			return err
-		}
-		if err := p.annotateFailedActions(ctx); err != nil {
-			return err
-		}
+		errs = append(errs, p.annotateFailedTests(ctx))
+		errs = append(errs, p.annotateFailedActions(ctx))
+		errs = append(errs, p.annotateFlakyTests(ctx))
+		errs = append(errs, p.annotateOverflow(ctx))
 	}
-	if err := p.postTestAnalytics(ctx); err != nil {
-		return err
+	if p.metaDataEnabled {
+		errs = append(errs, p.setBuildMetaData(ctx))
 	}
-	return nil
+	errs = append(errs, p.uploadRetryStep(ctx))
+	errs = append(errs, p.postTestAnalytics(ctx))
+	return newMultiError(errs...)
 }
 
-// testPreamble is the text posted before anything else in the error annotation at the top of the build
+// defaultTestPreamble is the text posted before anything else in the error annotation at the top of the build
 // if there is a failed test detected the build. The final two line breaks are important, because they
 // allow the formatting to be readable when we're posting the list of failed test targets.
-var testPreamble = `#### Failures
+var defaultTestPreamble = `#### Failures
 
-[Jump to job.](#%s)
+[Jump to job.](#{{.JobID}})
 
-:bulb: You can run the following failed test targets with ` + "`" + `bazel test [target]` + "`" + ` locally on your
-machine to reproduce the issues and iterate faster than having to wait for the CI again.
+:bulb: You can run the failed test targets locally on your machine to reproduce the issues and iterate faster than
+having to wait for the CI again:
 
-If a particular test target is too slow locally, you can also use ` + "`" + `sg ci bazel test [target]` + "`" + ` to have the CI run that
-particular target only.
+{{if .ReproduceCommand}}` + "```" + `
+{{.ReproduceCommand}}
+` + "```" + `{{end}}
 
 
 `
 
+// testPreambleData holds the values available to the test preamble template.
+type testPreambleData struct {
+	// JobID is the Buildkite job ID, which is also the anchor of the job in the build page.
+	JobID string
+	// BuildURL is the URL of the Buildkite build.
+	BuildURL string
+	// FailedLabels are the labels of the failed test targets, in the order they were reported.
+	FailedLabels []string
+	// ReproduceCommand is the command to run all failed test targets locally.
+	ReproduceCommand string
+}
+
+// parseTestPreamble returns the test preamble template, read from path if set, from inline otherwise, or
+// the default one if none of them are.
+func parseTestPreamble(inline string, path string) (*template.Template, error) {
+	text := inline
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read test preamble: %w", err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		text = defaultTestPreamble
+	}
+	tmpl, err := template.New("test_preamble").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse test preamble: %w", err)
+	}
+	return tmpl, nil
+}
+
+// failedTestResults returns the results to report as failures: the last failed attempt of each shard and run
+// of the test targets that failed. Flaky targets are not considered as failed.
+func (p *BuildkitePlugin) failedTestResults() []*testResultInfo {
+	type execution struct {
+		label      string
+		run, shard int32
+	}
+	last := map[execution]*testResultInfo{}
+	var order []execution
+	for _, result := range p.testResultInfos {
+		if !result.Failed() || !result.TargetFailed() || p.isFlaky(result.label) {
+			continue
+		}
+		e := execution{label: result.label, run: result.run, shard: result.shard}
+		prev, ok := last[e]
+		if !ok {
+			order = append(order, e)
+		}
+		if !ok || result.attempt > prev.attempt {
+			last[e] = result
+		}
+	}
+
+	results := make([]*testResultInfo, 0, len(order))
+	for _, e := range order {
+		results = append(results, last[e])
+	}
+	return results
+}
+
+// failedTestLabels returns the labels of the failed tests, without duplicates. Flaky tests are not
+// considered as failed.
+func (p *BuildkitePlugin) failedTestLabels() []string {
+	var labels []string
+	seen := map[string]bool{}
+	for _, result := range p.failedTestResults() {
+		if !seen[result.label] {
+			seen[result.label] = true
+			labels = append(labels, result.label)
+		}
+	}
+	return labels
+}
+
+func (p *BuildkitePlugin) renderTestPreamble() ([]byte, error) {
+	labels := p.failedTestLabels()
+	command := []string{"bazel", "test"}
+	for _, label := range labels {
+		command = append(command, shellQuote(label))
+	}
+	data := testPreambleData{
+		JobID:            p.buildkiteJobID,
+		BuildURL:         os.Getenv("BUILDKITE_BUILD_URL"),
+		FailedLabels:     labels,
+		ReproduceCommand: strings.Join(command, " "),
+	}
+	var buf bytes.Buffer
+	if err := p.testPreamble.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render test preamble: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
 func (p *BuildkitePlugin) annotateFailedTests(ctx context.Context) error {
-	if len(p.testResultInfos) > 0 && !p.isPreamblePosted {
+	if len(p.failedTestLabels()) > 0 && !p.isPreamblePosted {
 		p.isPreamblePosted = true
-		if err := p.agent.Annotate(ctx, "error", fmt.Sprintf("failed_test_%s", p.buildkiteJobID), []byte(fmt.Sprintf(testPreamble, p.buildkiteJobID))); err != nil {
+		preamble, err := p.renderTestPreamble()
+		if err != nil {
+			return err
+		}
+		if err := p.annotate(ctx, "error", fmt.Sprintf("failed_test_%s", p.buildkiteJobID), preamble); err != nil {
 			return err
 		}
 	}
 
-	for _, result := range p.testResultInfos {
-		var testLogPath string
+	// Only the last attempt of each failed shard is reported, previous attempts failed the same way.
+	results := p.failedTestResults()
+	entries := make([]string, len(results))
+	err := p.forEach(ctx, len(results), func(ctx context.Context, i int) error {
+		m, err := p.renderFailedTest(ctx, results[i])
+		if err != nil {
+			return fmt.Errorf("failed to report %s: %w", results[i].Name(), err)
+		}
+		entries[i] = m
+		return nil
+	})
+	// Annotate with the entries that could be rendered, in order, even if some could not.
+	for _, m := range entries {
+		if m == "" {
+			continue
+		}
+		if err := p.annotate(ctx, "error", fmt.Sprintf("failed_test_%s", p.buildkiteJobID), []byte(m)); err != nil {
+			return err
+		}
+	}
+	return err
+}
 
-		for _, f := range result.result.GetTestActionOutput() {
-			if f.GetName() == "test.log" {
-				path, err := p.outputClient.GetFilePath(ctx, f.GetUri(), f.GetName())
-				if err != nil {
-					return err
-				}
-				testLogPath = path
+// renderFailedTest fetches the log of a failed test, uploads it and renders the annotation entry linking to it.
+func (p *BuildkitePlugin) renderFailedTest(ctx context.Context, result *testResultInfo) (string, error) {
+	var testLogPath string
+	var testLogURI string
+
+	for _, f := range result.result.GetTestActionOutput() {
+		if f.GetName() == "test.log" {
+			path, err := p.fetchOutput(ctx, f.GetUri(), result.artifactPath(f.GetName()))
+			if err != nil {
+				return "", err
 			}
+			testLogPath = path
+			testLogURI = f.GetUri()
 		}
+	}
 
-		// If the test failed, annotate and upload the artifact.
-		if result.Failed() {
-			m := renderFailedTestMarkdown(ctx, result)
-			if err := p.agent.Annotate(ctx, "error", fmt.Sprintf("failed_test_%s", p.buildkiteJobID), []byte(m)); err != nil {
-				return err
-			}
-			if testLogPath != "" {
-				if err := p.agent.UploadArtifacts(ctx, testLogPath); err != nil {
-					return err
-				}
-			}
+	// Upload the artifact and annotate, linking to it. Failed attempts of flaky tests are reported in their
+	// own annotation.
+	var artifactPath string
+	if testLogPath != "" {
+		path, err := p.uploadArtifact(ctx, testLogPath, result.artifactPath("test.log"))
+		if err != nil {
+			return "", err
 		}
+		artifactPath = path
 	}
-	return nil
+	return renderFailedTestMarkdown(ctx, p.outputClient, result, testLogURI, artifactPath, p.testLogLines)
 }
 
+// annotateFailedActions annotates the root causes of the build failures, which are usually failed actions, each
+// followed by the collapsed list of the targets which failed because of them.
 func (p *BuildkitePlugin) annotateFailedActions(ctx context.Context) error {
-	for _, action := range p.failedActions {
-		m, err := renderFailedActionMarkdown(ctx, p.outputClient, action)
+	entries := make([]string, len(p.failedActions))
+	err := p.forEach(ctx, len(p.failedActions), func(ctx context.Context, i int) error {
+		action := p.failedActions[i]
+		m, err := renderFailedActionMarkdown(ctx, p.outputClient, action, maxAnnotationSectionSize, p.uploadOverflow, p.sourceLinker)
 		if err != nil {
+			return fmt.Errorf("failed to report %s: %w", action.label, err)
+		}
+		entries[i] = m
+		return nil
+	})
+
+	if m := renderAbortedMarkdown(p.failures.aborted, p.failures.abortedDescription); m != "" {
+		if err := p.annotate(ctx, "error", "failed_actions", []byte(m)); err != nil {
+			return err
+		}
+	}
+
+	annotated := map[string]bool{}
+	for i, action := range p.failedActions {
+		m := entries[i]
+		if m == "" {
+			continue
+		}
+		if !annotated[action.label] {
+			annotated[action.label] = true
+			m += renderDependentsMarkdown(action.label, p.failures.dependents[action.label])
+		}
+		if err := p.annotate(ctx, "error", "failed_actions", []byte(m)); err != nil {
 			return err
 		}
-		if err := p.agent.Annotate(ctx, "error", "failed_actions", []byte(m)); err != nil {
+	}
+
+	// Root causes that are not actions, such as targets which failed to be analyzed.
+	for _, label := range p.failures.rootCauses {
+		if annotated[label] {
+			continue
+		}
+		m := renderFailedTargetMarkdown(label, p.failures.descriptions[label], p.failures.dependents[label])
+		if err := p.annotate(ctx, "error", "failed_actions", []byte(m)); err != nil {
 			return err
 		}
 	}
-	return nil
+
+	if m := renderSkippedTargetsMarkdown(p.failures.skipped); m != "" {
+		if err := p.annotate(ctx, "error", "failed_actions", []byte(m)); err != nil {
+			return err
+		}
+	}
+	return err
 }
 
 func (p *BuildkitePlugin) postTestAnalytics(ctx context.Context) error {
+	results := make([][]*AnalyticsTestPayload, len(p.testResultInfos))
+	err := p.forEach(ctx, len(p.testResultInfos), func(ctx context.Context, i int) error {
+		payloads, err := p.testResultPayloads(ctx, p.testResultInfos[i])
+		if err != nil {
+			return fmt.Errorf("failed to report %s: %w", p.testResultInfos[i].Name(), err)
+		}
+		results[i] = payloads
+		return nil
+	})
+	// Post the results that could be gathered, in order, even if some could not.
 	payloads := []*AnalyticsTestPayload{}
-	for _, result := range p.testResultInfos {
-		var testLogPath string
-		var testXMLPath string
-
-		for _, f := range result.result.GetTestActionOutput() {
-			if f.GetName() == "test.log" {
-				path, err := p.outputClient.GetFilePath(ctx, f.GetUri(), f.GetName())
-				if err != nil {
-					return err
-				}
-				testLogPath = path
+	for _, r := range results {
+		payloads = append(payloads, r...)
+	}
+
+	if p.dryRun {
+		fmt.Println("savings results payload test results to: testresults.json")
+		return newMultiError(err, SaveTestResults(payloads))
+	} else {
+		return newMultiError(err, PostResults(ctx, p.buildkiteAnalyticsURL, p.buildkiteAnalyticsToken, payloads))
+	}
+}
+
+// testResultPayloads fetches the outputs of a test result to build its analytics payloads, uploading its JUnit
+// XML report as well if configured to.
+func (p *BuildkitePlugin) testResultPayloads(ctx context.Context, result *testResultInfo) ([]*AnalyticsTestPayload, error) {
+	var testLogPath string
+	var testXMLPath string
+
+	for _, f := range result.result.GetTestActionOutput() {
+		if f.GetName() == "test.log" {
+			path, err := p.fetchOutput(ctx, f.GetUri(), result.artifactPath(f.GetName()))
+			if err != nil {
+				return nil, err
 			}
-			if f.GetName() == "test.xml" {
-				path, err := p.outputClient.GetFilePath(ctx, f.GetUri(), f.GetName())
-				if err != nil {
-					return err
-				}
-				testXMLPath = path
+			testLogPath = path
+		}
+		if f.GetName() == "test.xml" {
+			path, err := p.fetchOutput(ctx, f.GetUri(), result.artifactPath(f.GetName()))
+			if err != nil {
+				return nil, err
 			}
+			testXMLPath = path
 		}
+	}
 
-		// Handle JUnit XML upload for configured targets
-		if p.shouldUploadJUnitXML(result.label) && testXMLPath != "" {
-			if p.dryRun {
-				fmt.Printf("Would upload JUnit XML for target %s: %s\n", result.label, testXMLPath)
-			} else if err := PostJUnitXML(ctx, p.junitXMLBuildkiteAnalyticsToken, testXMLPath); err != nil {
-				return fmt.Errorf("failed to upload JUnit XML for %s: %w", result.label, err)
-			}
+	// Handle JUnit XML upload for configured targets
+	if p.shouldUploadJUnitXML(result.label) && testXMLPath != "" {
+		if p.dryRun {
+			fmt.Printf("Would upload JUnit XML for target %s: %s\n", result.label, testXMLPath)
+		} else if err := PostJUnitXML(ctx, p.buildkiteAnalyticsURL, p.junitXMLBuildkiteAnalyticsToken, testXMLPath); err != nil {
+			return nil, fmt.Errorf("failed to upload JUnit XML for %s: %w", result.label, err)
 		}
+	}
 
-		payload, err := result.AnalyticsPayload(p.testLabelPrefix, testLogPath)
+	// Report each test case individually when the test runner wrote a JUnit XML report, so we can
+	// tell which test inside the target regressed. Otherwise report the target as a whole.
+	if testXMLPath != "" {
+		cases, err := result.TestCasePayloads(p.testLabelPrefix, testXMLPath)
 		if err != nil {
-			return err
+			fmt.Printf("failed to read test cases of %s, reporting the target instead: %s\n", result.label, err)
+		} else if len(cases) > 0 {
+			return cases, nil
 		}
-		payloads = append(payloads, payload)
 	}
 
-	if p.dryRun {
-		fmt.Println("savings results payload test results to: testresults.json")
-		return SaveTestResults(payloads)
-	} else {
-		return PostResults(ctx, p.buildkiteAnalyticsToken, payloads)
+	payload, err := result.AnalyticsPayload(p.testLabelPrefix, testLogPath)
+	if err != nil {
+		return nil, err
 	}
+	return []*AnalyticsTestPayload{payload}, nil
 }
 
-func renderFailedTestMarkdown(ctx context.Context, ft *testResultInfo) string {
-	return fmt.Sprintf("- **Failed test** `%s`\n", ft.label)
+// renderFailedTestMarkdown renders the annotation entry of a failed test. If the test produced a log, it links
+// to the uploaded artifact at artifactPath and inlines its last lines (read from logURI) in a collapsible block.
+func renderFailedTestMarkdown(ctx context.Context, client *outputfile.Client, ft *testResultInfo, logURI string, artifactPath string, lines int) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("- **Failed test** `%s`", ft.Name()))
+	if artifactPath != "" {
+		sb.WriteString(fmt.Sprintf(" ([test.log](artifact://%s))", artifactPath))
+	}
+	sb.WriteString("\n")
+	if logURI == "" || lines <= 0 {
+		return sb.String(), nil
+	}
+
+	// The excerpt can't be larger than an annotation section anyway, there's no need to read more of logs that
+	// can be gigabytes large.
+	out, err := client.Tail(ctx, logURI, maxAnnotationSectionSize)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	b, err := io.ReadAll(out)
+	if err != nil {
+		return "", err
+	}
+	if len(b) == maxAnnotationSectionSize {
+		// The log is likely larger than what was read, and its first line cut.
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
+	}
+	tail, err := tailLines(bytes.NewReader(b), lines)
+	if err != nil {
+		return "", err
+	}
+	if len(tail) == 0 {
+		return sb.String(), nil
+	}
+	sb.WriteString(fmt.Sprintf("\n<details><summary>Last %d lines of <code>test.log</code></summary>\n\n", len(tail)))
+	// Even a few lines can be huge, keep the excerpt within what an annotation can hold.
+	excerpt, _ := truncateSection([]byte(strings.Join(tail, "\n")), maxAnnotationSectionSize)
+	sb.WriteString("```term\n")
+	sb.Write(excerpt)
+	sb.WriteString("\n```\n\n</details>\n\n")
+	return sb.String(), nil
 }
 
-func renderFailedActionMarkdown(ctx context.Context, client *outputfile.Client, fa *failedAction) (string, error) {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("**Action failed: `%s`**\n", fa.label))
-	if fa.stdoutURI != "" {
-		out, err := client.Open(ctx, fa.stdoutURI)
+// tailLines returns at most the n last lines read from r. Lines longer than an annotation section are truncated, as
+// test outputs are not always well behaved.
+func tailLines(r io.Reader, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	ring := make([]string, 0, n)
+	start := 0
+	reader := bufio.NewReader(r)
+	var line []byte
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		defer out.Close()
-		sb.WriteString("_stdout_:\n")
-		sb.WriteString("```term")
-		if _, err := io.Copy(&sb, out); err != nil {
-			return "", err
+		if room := maxAnnotationSectionSize - len(line); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			line = append(line, chunk...)
+		}
+		if isPrefix {
+			continue
+		}
+		if len(ring) < n {
+			ring = append(ring, string(line))
+		} else {
+			ring[start] = string(line)
+			start = (start + 1) % n
 		}
-		sb.WriteString("\n```\n")
+		line = line[:0]
 	}
-	if fa.stderrURI != "" {
-		out, err := client.Open(ctx, fa.stderrURI)
+	return append(ring[start:], ring[:start]...), nil
+}
+
+// renderFailedActionMarkdown renders the annotation entry of a failed action: a table of the compiler errors found
+// in its outputs, linked to the sources with link when possible, followed by the outputs themselves. Outputs
+// longer than sectionSize are truncated, and passed in full to overflow, which returns the path of the
+// artifact to link to.
+func renderFailedActionMarkdown(ctx context.Context, client *outputfile.Client, fa *failedAction, sectionSize int, overflow func(ctx context.Context, name string, data []byte) (string, error), link func(file string, line int) string) (string, error) {
+	type output struct {
+		name string
+		data []byte
+	}
+	var outputs []output
+	var diags []diagnostic
+	for _, stream := range []struct {
+		name string
+		uri  string
+	}{
+		{name: "stdout", uri: fa.stdoutURI},
+		{name: "stderr", uri: fa.stderrURI},
+	} {
+		if stream.uri == "" {
+			continue
+		}
+		b, err := readOutput(ctx, client, stream.uri)
 		if err != nil {
 			return "", err
 		}
-		defer out.Close()
-		sb.WriteString("_stderr_:\n")
-		sb.WriteString("```term\n")
-		if _, err := io.Copy(&sb, out); err != nil {
+		outputs = append(outputs, output{name: stream.name, data: b})
+		diags = append(diags, parseDiagnostics(b)...)
+	}
+	if len(diags) > maxDiagnostics {
+		diags = diags[:maxDiagnostics]
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("**Action failed: `%s`**\n", fa.label))
+	sb.WriteString(renderDiagnosticsMarkdown(diags, link))
+	for _, out := range outputs {
+		if err := renderOutputSection(ctx, &sb, fa.artifactPath(out.name+".log"), out.name, out.data, sectionSize, overflow); err != nil {
 			return "", err
 		}
-		sb.WriteString("\n```\n")
 	}
 	return sb.String(), nil
 }
+
+func readOutput(ctx context.Context, client *outputfile.Client, uri string) ([]byte, error) {
+	out, err := client.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	return io.ReadAll(out)
+}
+
+// renderOutputSection writes an output in a code block, truncating it if necessary, in which case it is passed in
+// full to overflow under relPath.
+func renderOutputSection(ctx context.Context, sb *strings.Builder, relPath string, name string, b []byte, sectionSize int, overflow func(ctx context.Context, name string, data []byte) (string, error)) error {
+	content, truncated := truncateSection(b, sectionSize)
+	sb.WriteString(fmt.Sprintf("_%s_:\n", name))
+	if truncated {
+		artifactPath, err := overflow(ctx, relPath, b)
+		if err != nil {
+			return err
+		}
+		sb.WriteString(fmt.Sprintf("_(truncated, see the [full %s](artifact://%s))_\n", name, artifactPath))
+	}
+	sb.WriteString("```term\n")
+	sb.Write(content)
+	sb.WriteString("\n```\n")
+	return nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/aspect-cli-plugin-buildkite/bazel/bytestream/bytestreamtest"
+
+	"aspect.build/cli/bazel/buildeventstream"
+	aspectplugin "aspect.build/cli/pkg/plugin/sdk/v1alpha3/plugin"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// outputs gives URIs to the files in testdata/outputs, either local or served by a bytestream server.
+type outputs func(t *testing.T, name string) string
+
+// TestHookGolden feeds builds to BEPEventCallback, runs the hook, and compares what would have been annotated
+// and uploaded with testdata/<test name>.golden. Run with -update to update the golden files.
+func TestHookGolden(t *testing.T) {
+	server, err := bytestreamtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	local := func(t *testing.T, name string) string {
+		path, err := filepath.Abs(filepath.Join("testdata", "outputs", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "file://" + filepath.ToSlash(path)
+	}
+	remote := func(t *testing.T, name string) string {
+		b, err := os.ReadFile(filepath.Join("testdata", "outputs", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server.PutBlob(b)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		outputs outputs
+		build   func(t *testing.T, out outputs) []*buildeventstream.BuildEvent
+	}{
+		{name: "failed_tests", outputs: local, build: failedTestsBuild},
+		{name: "failed_actions", outputs: local, build: failedActionsBuild},
+		{name: "remote_outputs", outputs: remote, build: remoteOutputsBuild},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			agent := newRecordingAgent()
+			p := newTestPlugin(t, agent)
+			for _, event := range tc.build(t, tc.outputs) {
+				if err := p.BEPEventCallback(event); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.hook(false, nil); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, filepath.Join("testdata", tc.name+".golden"), renderRecording(agent))
+		})
+	}
+}
+
+// TestFailedActionsOverflow checks that the outputs too long to be annotated of several actions of a same target
+// are uploaded as distinct artifacts.
+func TestFailedActionsOverflow(t *testing.T) {
+	agent := newRecordingAgent()
+	p := newTestPlugin(t, agent)
+	dir := t.TempDir()
+	for i := 1; i <= 2; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("stderr_%d", i))
+		b := []byte(strings.Repeat(fmt.Sprintf("action %d failed\n", i), maxAnnotationSectionSize))
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.BEPEventCallback(actionEvent("//lib:lib", outputFile("stderr", "file://"+filepath.ToSlash(path)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.hook(false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		path := fmt.Sprintf("lib/lib/action_%d_GoCompilePkg/stderr.log", i)
+		b, ok := agent.Artifact(path)
+		if !ok {
+			t.Fatalf("%s was not uploaded, got %v", path, agent.Artifacts())
+		}
+		if want := fmt.Sprintf("action %d failed\n", i); !strings.HasPrefix(string(b), want) {
+			t.Errorf("%s starts with %q, want %q", path, b[:len(want)], want)
+		}
+	}
+}
+
+// TestShardsWithoutSummary checks that the logs of the shards of a test are uploaded under distinct paths when
+// the build is interrupted before the summary of the test is reported.
+func TestShardsWithoutSummary(t *testing.T) {
+	agent := newRecordingAgent()
+	p := newTestPlugin(t, agent)
+	dir := t.TempDir()
+	for shard := int32(1); shard <= 2; shard++ {
+		path := filepath.Join(dir, fmt.Sprintf("shard_%d.log", shard))
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("FAIL: shard %d\n", shard)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		event := testResultEvent("//server:server_test", 1, shard, 1, buildeventstream.TestStatus_FAILED, outputFile("test.log", "file://"+filepath.ToSlash(path)))
+		if err := p.BEPEventCallback(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.hook(false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for shard := 1; shard <= 2; shard++ {
+		path := fmt.Sprintf("server/server_test/shard_%d/run_1/test.log", shard)
+		b, ok := agent.Artifact(path)
+		if want := fmt.Sprintf("FAIL: shard %d\n", shard); !ok || string(b) != want {
+			t.Errorf("%s = %q, want %q, got the artifacts %v", path, b, want, agent.Artifacts())
+		}
+	}
+}
+
+// TestHookPrunesDownloadCache checks that the outputs kept in the download cache across invocations are removed
+// once they went unused for too long.
+func TestHookPrunesDownloadCache(t *testing.T) {
+	p := newTestPlugin(t, newRecordingAgent())
+	dir := t.TempDir()
+	p.downloadCacheDir = dir
+	p.downloadCacheMaxAge = 24 * time.Hour
+	p.outputClient.SetCacheDir(dir)
+
+	stale := filepath.Join(dir, "sha256", "ab", "ab01_4")
+	recent := filepath.Join(dir, "sha256", "cd", "cd01_4")
+	for _, path := range []string{stale, recent} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("blob"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	long := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(stale, long, long); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.hook(false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("the stale output is still cached: %v", err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("the recent output was pruned: %v", err)
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	long := strings.Repeat("x", 2*1024*1024)
+	for _, tc := range []struct {
+		name  string
+		input string
+		n     int
+		want  []string
+	}{
+		{name: "fewer lines", input: "a\nb\n", n: 3, want: []string{"a", "b"}},
+		{name: "more lines", input: "a\nb\nc\nd", n: 2, want: []string{"c", "d"}},
+		{name: "empty", input: "", n: 2},
+		{name: "long line", input: "a\n" + long + "\nb\n", n: 2, want: []string{long[:maxAnnotationSectionSize], "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tailLines(strings.NewReader(tc.input), tc.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") || len(got) != len(tc.want) {
+				t.Errorf("tailLines() returned %d lines, want %d: %.80q", len(got), len(tc.want), got)
+			}
+		})
+	}
+}
+
+// newTestPlugin sets up the plugin as if it were running in a Buildkite job, recording what it does with agent.
+func newTestPlugin(t *testing.T, agent BuildkiteAgent) *BuildkitePlugin {
+	t.Helper()
+	for k, v := range map[string]string{
+		"BUILDKITE":                 "true",
+		"BUILDKITE_JOB_ID":          "job-1",
+		"BUILDKITE_BUILD_URL":       "https://buildkite.com/acme/app/builds/42",
+		"BUILDKITE_REPO":            "git@github.com:acme/app.git",
+		"BUILDKITE_COMMIT":          "0123456789abcdef",
+		"BUILDKITE_ANALYTICS_TOKEN": "",
+		"TEST_ANALYTICS_PREFIX":     "",
+		retryStepEnv:                "",
+	} {
+		t.Setenv(k, v)
+	}
+
+	p := &BuildkitePlugin{}
+	properties := fmt.Sprintf(`enable_annotations: true
+enable_metadata: true
+artifacts_dir: %s
+retry:
+  enabled: true
+  queue: bazel
+`, t.TempDir())
+	if err := p.Setup(&aspectplugin.SetupConfig{Properties: []byte(properties)}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.outputClient.Close)
+	p.agent = agent
+	return p
+}
+
+// renderRecording renders the annotations in the order they were posted, followed by the artifacts, the
+// meta-data and the uploaded pipelines.
+func renderRecording(agent *recordingAgent) string {
+	var sb strings.Builder
+	for _, a := range agent.Annotations() {
+		sb.WriteString(fmt.Sprintf("=== annotate --style %s --context %s\n", a.Style, a.Context))
+		sb.WriteString(a.Markdown)
+		if !strings.HasSuffix(a.Markdown, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	for _, path := range agent.Artifacts() {
+		b, _ := agent.Artifact(path)
+		sb.WriteString(fmt.Sprintf("=== artifact %s\n", path))
+		sb.Write(b)
+		if len(b) > 0 && b[len(b)-1] != '\n' {
+			sb.WriteString("\n")
+		}
+	}
+	metaData := agent.MetaData()
+	keys := make([]string, 0, len(metaData))
+	for k := range metaData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sb.WriteString(fmt.Sprintf("=== meta-data %s\n%s\n", k, metaData[k]))
+	}
+	for _, pipeline := range agent.Pipelines() {
+		sb.WriteString("=== pipeline upload\n" + pipeline)
+	}
+	return sb.String()
+}
+
+func checkGolden(t *testing.T, path string, got string) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s, run the tests with -update to create it", err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s, run the tests with -update to see how\n--- got:\n%s", path, got)
+	}
+}
+
+// failedTestsBuild has a failed test, a flaky test, a test that passed and one whose result was cached.
+func failedTestsBuild(t *testing.T, out outputs) []*buildeventstream.BuildEvent {
+	return []*buildeventstream.BuildEvent{
+		startedEvent("0b1e6e3c-5b0f-4b8e-9d0a-3f1c2d4e5f60"),
+		testResultEvent("//server:server_test", 1, 1, 1, buildeventstream.TestStatus_FAILED, outputFile("test.log", out(t, "server_test.log"))),
+		testSummaryEvent("//server:server_test", buildeventstream.TestStatus_FAILED, 1, 1),
+		testResultEvent("//client:client_test", 1, 1, 1, buildeventstream.TestStatus_FAILED, outputFile("test.log", out(t, "client_test_attempt_1.log"))),
+		testResultEvent("//client:client_test", 1, 1, 2, buildeventstream.TestStatus_PASSED),
+		testSummaryEvent("//client:client_test", buildeventstream.TestStatus_FLAKY, 2, 1, outputFile("test.log", out(t, "client_test_attempt_1.log"))),
+		testResultEvent("//util:util_test", 1, 1, 1, buildeventstream.TestStatus_PASSED),
+		testSummaryEvent("//util:util_test", buildeventstream.TestStatus_PASSED, 1, 1),
+		targetBuiltEvent("//util:util_test"),
+		cachedTestSummaryEvent("//api:api_test"),
+		targetBuiltEvent("//api:api_test"),
+	}
+}
+
+// failedActionsBuild has a library failing to compile, breaking the targets depending on it, a target that
+// could not be analyzed, a target left incomplete, a target incompatible with the platform, and pending targets
+// reported when the build was interrupted.
+func failedActionsBuild(t *testing.T, out outputs) []*buildeventstream.BuildEvent {
+	lib := actionCompletedID("//lib:lib")
+	return []*buildeventstream.BuildEvent{
+		actionEvent("//lib:lib", outputFile("stderr", out(t, "lib_stderr.txt"))),
+		targetCompletedEvent("//lib:lib", lib),
+		targetCompletedEvent("//app:app", lib),
+		targetCompletedEvent("//cmd/server:server", lib),
+		abortedEvent("//tools:gen", buildeventstream.Aborted_ANALYSIS_FAILURE, "no such package 'third_party/gen': BUILD file not found"),
+		abortedEvent("//docs:docs", buildeventstream.Aborted_INCOMPLETE, ""),
+		abortedEvent("//tools/windows:installer", buildeventstream.Aborted_SKIPPED, ""),
+		abortedEvent("//e2e:e2e_test", buildeventstream.Aborted_USER_INTERRUPTED, "Build was interrupted."),
+		abortedEvent("//e2e:smoke_test", buildeventstream.Aborted_USER_INTERRUPTED, "Build was interrupted."),
+	}
+}
+
+// remoteOutputsBuild has a sharded test and an action failing, whose outputs are stored in a remote cache.
+func remoteOutputsBuild(t *testing.T, out outputs) []*buildeventstream.BuildEvent {
+	return []*buildeventstream.BuildEvent{
+		testResultEvent("//server:server_test", 1, 1, 1, buildeventstream.TestStatus_PASSED),
+		testResultEvent("//server:server_test", 1, 2, 1, buildeventstream.TestStatus_FAILED, outputFile("test.log", out(t, "server_test.log"))),
+		testSummaryEvent("//server:server_test", buildeventstream.TestStatus_FAILED, 1, 2),
+		actionEvent("//lib:lib", outputFile("stderr", out(t, "lib_stderr.txt"))),
+		targetCompletedEvent("//lib:lib", actionCompletedID("//lib:lib")),
+	}
+}
+
+func startedEvent(uuid string) *buildeventstream.BuildEvent {
+	return &buildeventstream.BuildEvent{
+		Id:      &buildeventstream.BuildEventId{Id: &buildeventstream.BuildEventId_Started{Started: &buildeventstream.BuildEventId_BuildStartedId{}}},
+		Payload: &buildeventstream.BuildEvent_Started{Started: &buildeventstream.BuildStarted{Uuid: uuid}},
+	}
+}
+
+func outputFile(name string, uri string) *buildeventstream.File {
+	return &buildeventstream.File{Name: name, File: &buildeventstream.File_Uri{Uri: uri}}
+}
+
+func testResultEvent(label string, run int32, shard int32, attempt int32, status buildeventstream.TestStatus, outputs ...*buildeventstream.File) *buildeventstream.BuildEvent {
+	return &buildeventstream.BuildEvent{
+		Id: &buildeventstream.BuildEventId{Id: &buildeventstream.BuildEventId_TestResult{
+			TestResult: &buildeventstream.BuildEventId_TestResultId{Label: label, Run: run, Shard: shard, Attempt: attempt},
+		}},
+		Payload: &buildeventstream.BuildEvent_TestResult{TestResult: &buildeventstream.TestResult{
+			Status:           status,
+			TestActionOutput: outputs,
+		}},
+	}
+}
+
+func testSummaryEvent(label string, status buildeventstream.TestStatus, attempts int32, shards int32, failed ...*buildeventstream.File) *buildeventstream.BuildEvent {
+	return &buildeventstream.BuildEvent{
+		Id: &buildeventstream.BuildEventId{Id: &buildeventstream.BuildEventId_TestSummary{
+			TestSummary: &buildeventstream.BuildEventId_TestSummaryId{Label: label},
+		}},
+		Payload: &buildeventstream.BuildEvent_TestSummary{TestSummary: &buildeventstream.TestSummary{
+			OverallStatus: status,
+			RunCount:      1,
+			AttemptCount:  attempts,
+			ShardCount:    shards,
+			Failed:        failed,
+		}},
+	}
+}
+
+func cachedTestSummaryEvent(label string) *buildeventstream.BuildEvent {
+	event := testSummaryEvent(label, buildeventstream.TestStatus_PASSED, 1, 1)
+	event.GetTestSummary().TotalRunCount = 1
+	event.GetTestSummary().TotalNumCached = 1
+	return event
+}
+
+func actionCompletedID(label string) *buildeventstream.BuildEventId {
+	return &buildeventstream.BuildEventId{Id: &buildeventstream.BuildEventId_ActionCompleted{
+		ActionCompleted: &buildeventstream.BuildEventId_ActionCompletedId{Label: label},
+	}}
+}
+
+func actionEvent(label string, stderr *buildeventstream.File) *buildeventstream.BuildEvent {
+	return &buildeventstream.BuildEvent{
+		Id: actionCompletedID(label),
+		Payload: &buildeventstream.BuildEvent_Action{Action: &buildeventstream.ActionExecuted{
+			Success:  false,
+			Type:     "GoCompilePkg",
+			ExitCode: 1,
+			Stderr:   stderr,
+		}},
+	}
+}
+
+func targetCompletedID(label string) *buildeventstream.BuildEventId {
+	return &buildeventstream.BuildEventId{Id: &buildeventstream.BuildEventId_TargetCompleted{
+		TargetCompleted: &buildeventstream.BuildEventId_TargetCompletedId{Label: label},
+	}}
+}
+
+func targetCompletedEvent(label string, causes ...*buildeventstream.BuildEventId) *buildeventstream.BuildEvent {
+	return &buildeventstream.BuildEvent{
+		Id:       targetCompletedID(label),
+		Children: causes,
+		Payload:  &buildeventstream.BuildEvent_Completed{Completed: &buildeventstream.TargetComplete{Success: false}},
+	}
+}
+
+func targetBuiltEvent(label string) *buildeventstream.BuildEvent {
+	return &buildeventstream.BuildEvent{
+		Id:      targetCompletedID(label),
+		Payload: &buildeventstream.BuildEvent_Completed{Completed: &buildeventstream.TargetComplete{Success: true}},
+	}
+}
+
+func abortedEvent(label string, reason buildeventstream.Aborted_AbortReason, description string) *buildeventstream.BuildEvent {
+	return &buildeventstream.BuildEvent{
+		Id: targetCompletedID(label),
+		Payload: &buildeventstream.BuildEvent_Aborted{Aborted: &buildeventstream.Aborted{
+			Reason:      reason,
+			Description: description,
+		}},
+	}
+}
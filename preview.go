@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultAnnotationPreviewDir is where the annotation previews are written, under the system temporary directory,
+// when the annotation_preview_dir property isn't set.
+const defaultAnnotationPreviewDir = "buildkite-annotations"
+
+// annotationPreviewTemplate renders an annotation context as a card resembling the ones of the Buildkite UI.
+var annotationPreviewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Context}}</title>
+<style>
+body { background: #f9f9f9; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 14px; color: #111; margin: 2em auto; max-width: 1100px; }
+.context { color: #888; font-size: 12px; margin-bottom: 4px; }
+.annotation { background: #fff; border: 1px solid #ddd; border-left-width: 4px; border-radius: 4px; padding: 12px 16px; }
+.annotation.error { border-left-color: #f83f23; }
+.annotation.warning { border-left-color: #ff9800; }
+.annotation.info { border-left-color: #1e88e5; }
+.annotation.success { border-left-color: #2ecc40; }
+pre { background: #1e1e1e; color: #ddd; border-radius: 3px; padding: 8px; overflow-x: auto; font-size: 12px; }
+code { font-family: SFMono-Regular, Monaco, Menlo, Consolas, monospace; }
+:not(pre) > code { background: #f2f2f2; border-radius: 3px; padding: 1px 4px; }
+table { border-collapse: collapse; margin: 8px 0; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: left; }
+blockquote { border-left: 3px solid #ddd; margin: 8px 0; padding-left: 12px; color: #555; }
+summary { cursor: pointer; }
+</style>
+</head>
+<body>
+<div class="context">{{.Context}} ({{.Style}})</div>
+<div class="annotation {{.Style}}">
+{{.Body}}
+</div>
+</body>
+</html>
+`))
+
+// writeAnnotationPreview renders the Markdown posted to an annotation context as an HTML page at path.
+func writeAnnotationPreview(path string, style string, annotationContext string, markdown string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = annotationPreviewTemplate.Execute(f, struct {
+		Context string
+		Style   string
+		Body    template.HTML
+	}{
+		Context: annotationContext,
+		Style:   style,
+		Body:    template.HTML(renderMarkdownHTML(markdown)),
+	})
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// renderMarkdownHTML renders the subset of Markdown used in annotations as HTML: headings, paragraphs, lists,
+// block quotes, fenced code blocks, tables, and inline code, emphasis and links. Lines starting with an HTML tag,
+// such as <details>, are passed through as Buildkite does.
+func renderMarkdownHTML(md string) string {
+	var sb strings.Builder
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			sb.WriteString("<p>" + renderInlineMarkdown(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+
+	lines := strings.Split(md, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		switch {
+		case line == "":
+			flush()
+
+		case strings.HasPrefix(line, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			sb.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+
+		case markdownHeading.MatchString(line):
+			flush()
+			m := markdownHeading.FindStringSubmatch(line)
+			sb.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", len(m[1]), renderInlineMarkdown(m[2]), len(m[1])))
+
+		case strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* "):
+			flush()
+			sb.WriteString("<ul>\n")
+			for ; i < len(lines); i++ {
+				item := strings.TrimSpace(lines[i])
+				if !strings.HasPrefix(item, "- ") && !strings.HasPrefix(item, "* ") {
+					break
+				}
+				sb.WriteString("<li>" + renderInlineMarkdown(item[2:]) + "</li>\n")
+			}
+			sb.WriteString("</ul>\n")
+			i--
+
+		case strings.HasPrefix(line, ">"):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quoted = append(quoted, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"), " "))
+			}
+			sb.WriteString("<blockquote>\n" + renderMarkdownHTML(strings.Join(quoted, "\n")) + "</blockquote>\n")
+			i--
+
+		case strings.HasPrefix(line, "|") && i+1 < len(lines) && markdownTableSeparator.MatchString(strings.TrimSpace(lines[i+1])):
+			flush()
+			sb.WriteString("<table>\n<tr>")
+			for _, cell := range splitTableRow(line) {
+				sb.WriteString("<th>" + renderInlineMarkdown(cell) + "</th>")
+			}
+			sb.WriteString("</tr>\n")
+			for i += 2; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "|"); i++ {
+				sb.WriteString("<tr>")
+				for _, cell := range splitTableRow(strings.TrimSpace(lines[i])) {
+					sb.WriteString("<td>" + renderInlineMarkdown(cell) + "</td>")
+				}
+				sb.WriteString("</tr>\n")
+			}
+			sb.WriteString("</table>\n")
+			i--
+
+		case strings.HasPrefix(line, "<"):
+			flush()
+			sb.WriteString(line + "\n")
+
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+	flush()
+	return sb.String()
+}
+
+var (
+	markdownHeading        = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	markdownTableSeparator = regexp.MustCompile(`^\|?(\s*:?-+:?\s*\|)+\s*(:?-+:?\s*)?$`)
+	markdownCodeSpan       = regexp.MustCompile("`([^`]+)`")
+	markdownLink           = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownBold           = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownItalic         = regexp.MustCompile(`(^|[\s(])[_*]([^_*]+)[_*]([\s).,:;!?]|$)`)
+	markdownEmoji          = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+)
+
+// emojis are the shortcodes used in annotations.
+var emojis = map[string]string{
+	"bulb":               "\U0001F4A1",
+	"information_source": "ℹ️",
+	"rotating_light":     "\U0001F6A8",
+	"warning":            "⚠️",
+	"white_check_mark":   "✅",
+	"x":                  "❌",
+}
+
+// splitTableRow returns the cells of a table row, where "\|" is a pipe in a cell rather than a separator.
+func splitTableRow(row string) []string {
+	row = strings.TrimSuffix(strings.TrimPrefix(row, "|"), "|")
+	cells := strings.Split(strings.ReplaceAll(row, `\|`, "\x00"), "|")
+	for i, cell := range cells {
+		cells[i] = strings.TrimSpace(strings.ReplaceAll(cell, "\x00", "|"))
+	}
+	return cells
+}
+
+// renderInlineMarkdown renders code spans, links, emphasis and emojis, escaping everything else.
+func renderInlineMarkdown(text string) string {
+	// Set code spans aside first, nothing inside them is to be rendered.
+	var spans []string
+	text = markdownCodeSpan.ReplaceAllStringFunc(text, func(s string) string {
+		spans = append(spans, "<code>"+html.EscapeString(s[1:len(s)-1])+"</code>")
+		return fmt.Sprintf("\x00%d\x00", len(spans)-1)
+	})
+
+	// Entities such as the ones escaping diagnostics in tables render as the character they stand for, so
+	// unescape them first rather than escaping them twice.
+	text = html.EscapeString(html.UnescapeString(text))
+	text = markdownLink.ReplaceAllString(text, `<a href="$2">$1</a>`)
+	text = markdownBold.ReplaceAllString(text, "<strong>$1</strong>")
+	text = markdownItalic.ReplaceAllString(text, "$1<em>$2</em>$3")
+	text = markdownEmoji.ReplaceAllStringFunc(text, func(s string) string {
+		if e, ok := emojis[s[1:len(s)-1]]; ok {
+			return e
+		}
+		return s
+	})
+
+	for i, span := range spans {
+		text = strings.Replace(text, fmt.Sprintf("\x00%d\x00", i), span, 1)
+	}
+	return text
+}
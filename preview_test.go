@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRenderMarkdownHTML(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		md   string
+		want string
+	}{
+		{
+			name: "heading and paragraph",
+			md:   "#### Failed tests\n\n[Jump to job.](#job-1) :bulb: **2** _failed_\n",
+			want: "<h4>Failed tests</h4>\n<p><a href=\"#job-1\">Jump to job.</a> \U0001F4A1 <strong>2</strong> <em>failed</em></p>\n",
+		},
+		{
+			name: "list with code spans",
+			md:   "- `//lib:lib` <failed>\n- [`a_b_c.go:12`](https://example.com/a?b=1&c=2)\n",
+			want: "<ul>\n<li><code>//lib:lib</code> &lt;failed&gt;</li>\n<li><a href=\"https://example.com/a?b=1&amp;c=2\"><code>a_b_c.go:12</code></a></li>\n</ul>\n",
+		},
+		{
+			name: "code fence",
+			md:   "```term\n--- FAIL: <TestFoo> **x**\n```\n",
+			want: "<pre><code>--- FAIL: &lt;TestFoo&gt; **x**</code></pre>\n",
+		},
+		{
+			name: "table with escaped pipes",
+			md:   "| File | Message |\n| --- | --- |\n| `a.go:1` | want a \\| b |\n",
+			want: "<table>\n<tr><th>File</th><th>Message</th></tr>\n<tr><td><code>a.go:1</code></td><td>want a | b</td></tr>\n</table>\n",
+		},
+		{
+			name: "table with a diagnostic",
+			md:   "| Location | Error |\n| --- | --- |\n| `set.go:3` | " + markdownTableEscaper.Replace("cannot infer T in Set<T> (a && b)") + " |\n",
+			want: "<table>\n<tr><th>Location</th><th>Error</th></tr>\n<tr><td><code>set.go:3</code></td><td>cannot infer T in Set&lt;T&gt; (a &amp;&amp; b)</td></tr>\n</table>\n",
+		},
+		{
+			name: "raw html",
+			md:   "<details>\n<summary>Log</summary>\n\n> quoted\n\n</details>\n",
+			want: "<details>\n<summary>Log</summary>\n<blockquote>\n<p>quoted</p>\n</blockquote>\n</details>\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := renderMarkdownHTML(tc.md); got != tc.want {
+				t.Errorf("renderMarkdownHTML() =\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
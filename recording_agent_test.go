@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// recordingAgent is a BuildkiteAgent recording the calls made to it instead of running buildkite-agent,
+// so tests can check what would have been annotated and uploaded. It's safe for concurrent use.
+type recordingAgent struct {
+	mu          sync.Mutex
+	annotations []recordedAnnotation
+	artifacts   map[string][]byte
+	metaData    map[string]string
+	pipelines   []string
+}
+
+// recordedAnnotation is a call to recordingAgent.Annotate.
+type recordedAnnotation struct {
+	Style    string
+	Context  string
+	Markdown string
+}
+
+func newRecordingAgent() *recordingAgent {
+	return &recordingAgent{artifacts: map[string][]byte{}, metaData: map[string]string{}}
+}
+
+// UploadArtifacts records the content of the files matching glob, as the files are usually removed once uploaded.
+func (a *recordingAgent) UploadArtifacts(ctx context.Context, dir string, glob string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, glob))
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no files match %q in %s", glob, dir)
+	}
+	for _, m := range matches {
+		b, err := os.ReadFile(m)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, m)
+		if err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.artifacts[filepath.ToSlash(rel)] = b
+		a.mu.Unlock()
+	}
+	return nil
+}
+
+func (a *recordingAgent) Annotate(ctx context.Context, style string, aCtx string, m []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.annotations = append(a.annotations, recordedAnnotation{Style: style, Context: aCtx, Markdown: string(m)})
+	return nil
+}
+
+func (a *recordingAgent) MetaDataSet(ctx context.Context, key string, value string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metaData[key] = value
+	return nil
+}
+
+func (a *recordingAgent) MetaDataGet(ctx context.Context, key string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	value, ok := a.metaData[key]
+	if !ok {
+		return "", fmt.Errorf("meta-data key %q not found", key)
+	}
+	return value, nil
+}
+
+func (a *recordingAgent) PipelineUpload(ctx context.Context, pipeline []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pipelines = append(a.pipelines, string(pipeline))
+	return nil
+}
+
+// Pipelines returns the uploaded pipelines, in the order they were uploaded.
+func (a *recordingAgent) Pipelines() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.pipelines...)
+}
+
+// MetaData returns a copy of the meta-data set so far.
+func (a *recordingAgent) MetaData() map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	metaData := make(map[string]string, len(a.metaData))
+	for k, v := range a.metaData {
+		metaData[k] = v
+	}
+	return metaData
+}
+
+// Annotations returns the annotations, in the order they were posted.
+func (a *recordingAgent) Annotations() []recordedAnnotation {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]recordedAnnotation(nil), a.annotations...)
+}
+
+// Artifacts returns the paths of the uploaded artifacts, sorted.
+func (a *recordingAgent) Artifacts() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	paths := make([]string, 0, len(a.artifacts))
+	for p := range a.artifacts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Artifact returns the content of the artifact uploaded at the given path.
+func (a *recordingAgent) Artifact(path string) ([]byte, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.artifacts[path]
+	return b, ok
+}
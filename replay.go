@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"aspect.build/cli/bazel/buildeventstream"
+	"aspect.build/cli/pkg/bazel"
+	aspectplugin "aspect.build/cli/pkg/plugin/sdk/v1alpha3/plugin"
+)
+
+const replayUsage = `usage: aspect buildkite replay [--binary] <bep file>
+
+Replays a build event protocol file recorded with --build_event_json_file (or
+--build_event_binary_file, when the file ends in .pb/.bin or --binary is given)
+through the plugin, then runs the post-build hook. The buildkite-agent is never
+called, commands are printed instead, as if the plugin was in pretend mode.`
+
+// CustomCommands contributes the 'buildkite' command, whose 'replay' subcommand lets us run the plugin
+// offline against a recorded build event protocol file.
+func (p *BuildkitePlugin) CustomCommands() ([]*aspectplugin.Command, error) {
+	return []*aspectplugin.Command{
+		aspectplugin.NewCommand(
+			"buildkite",
+			"Tools for the Buildkite plugin.",
+			replayUsage,
+			func(ctx context.Context, args []string, _ bazel.Bazel) error {
+				path, binaryFormat, err := parseReplayArgs(args)
+				if err != nil {
+					return err
+				}
+				return p.replay(path, binaryFormat)
+			},
+		),
+	}, nil
+}
+
+// parseReplayArgs returns the path of the BEP file to replay and whether it's in the binary format, from the
+// arguments of the buildkite command.
+func parseReplayArgs(args []string) (string, bool, error) {
+	if len(args) == 0 || args[0] != "replay" {
+		return "", false, errors.New(replayUsage)
+	}
+	binaryFormat := false
+	var path string
+	for _, arg := range args[1:] {
+		switch {
+		case arg == "--binary":
+			binaryFormat = true
+		case path == "":
+			path = arg
+		default:
+			return "", false, errors.New(replayUsage)
+		}
+	}
+	if path == "" {
+		return "", false, errors.New(replayUsage)
+	}
+	if ext := filepath.Ext(path); ext == ".pb" || ext == ".bin" {
+		binaryFormat = true
+	}
+	return path, binaryFormat, nil
+}
+
+// replay feeds every event of the BEP file at path to BEPEventCallback and then fires the hook,
+// exactly like aspect-cli would have done at the end of the build.
+func (p *BuildkitePlugin) replay(path string, binaryFormat bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to replay: %w", err)
+	}
+	defer f.Close()
+
+	// Replaying is a local operation, never talk to the real Buildkite.
+	if !p.dryRun {
+		p.agent = NewMockBuildkiteAgent("", p.annotationPreviewDir)
+		p.dryRun = true
+	}
+
+	read := readJSONBuildEvents
+	if binaryFormat {
+		read = readBinaryBuildEvents
+	}
+	if err := read(f, p.BEPEventCallback); err != nil {
+		return fmt.Errorf("failed to replay %s: %w", path, err)
+	}
+	return p.hook(false, nil)
+}
+
+// readJSONBuildEvents decodes a file written with --build_event_json_file, which holds one JSON
+// encoded build event per line.
+func readJSONBuildEvents(r io.Reader, fn func(*buildeventstream.BuildEvent) error) error {
+	scanner := bufio.NewScanner(r)
+	// Events such as the structured command line or large named sets can be much longer than
+	// the default token size.
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	unmarshaler := protojson.UnmarshalOptions{DiscardUnknown: true}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := scanner.Bytes()
+		if len(bytes.TrimSpace(b)) == 0 {
+			continue
+		}
+		var event buildeventstream.BuildEvent
+		if err := unmarshaler.Unmarshal(b, &event); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readBinaryBuildEvents decodes a file written with --build_event_binary_file, which holds
+// varint length-delimited build events.
+func readBinaryBuildEvents(r io.Reader, fn func(*buildeventstream.BuildEvent) error) error {
+	br := bufio.NewReader(r)
+	for i := 0; ; i++ {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("event %d: %w", i, err)
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return fmt.Errorf("event %d: %w", i, err)
+		}
+		var event buildeventstream.BuildEvent
+		if err := proto.Unmarshal(b, &event); err != nil {
+			return fmt.Errorf("event %d: %w", i, err)
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+}
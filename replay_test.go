@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"aspect.build/cli/bazel/buildeventstream"
+)
+
+// replayedBuild are the events recorded in testdata/replay, in both formats: a target which failed to be
+// analyzed, and another left incomplete because of it.
+func replayedBuild() []*buildeventstream.BuildEvent {
+	return []*buildeventstream.BuildEvent{
+		startedEvent("6d1f3b5e-2c4a-4f8e-9b7d-1a2b3c4d5e6f"),
+		abortedEvent("//tools:gen", buildeventstream.Aborted_ANALYSIS_FAILURE, "no such package 'third_party/gen': BUILD file not found"),
+		abortedEvent("//docs:docs", buildeventstream.Aborted_INCOMPLETE, ""),
+	}
+}
+
+// chdirTemp changes the working directory to a temporary one for the duration of the test, as replaying saves
+// the test results in the working directory.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestReplay(t *testing.T) {
+	live := newRecordingAgent()
+	p := newTestPlugin(t, live)
+	for _, event := range replayedBuild() {
+		if err := p.BEPEventCallback(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.hook(false, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := renderRecording(live)
+	if !strings.Contains(want, "//tools:gen") {
+		t.Fatalf("the live build annotated nothing about //tools:gen:\n%s", want)
+	}
+
+	for _, tc := range []struct {
+		file         string
+		binaryFormat bool
+	}{
+		{file: "build.json"},
+		{file: "build.pb", binaryFormat: true},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			path, err := filepath.Abs(filepath.Join("testdata", "replay", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			agent := newRecordingAgent()
+			p := newTestPlugin(t, agent)
+			// Record what's annotated rather than rendering previews.
+			p.dryRun = true
+			chdirTemp(t)
+			if err := p.replay(path, tc.binaryFormat); err != nil {
+				t.Fatal(err)
+			}
+			if got := renderRecording(agent); got != want {
+				t.Errorf("replaying %s annotated:\n%s\nwant, as the live build:\n%s", tc.file, got, want)
+			}
+		})
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	dir := t.TempDir()
+	truncated := func(name string, cut int) string {
+		b, err := os.ReadFile(filepath.Join("testdata", "replay", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b[:len(b)-cut], 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for _, tc := range []struct {
+		name         string
+		path         string
+		binaryFormat bool
+		wantErr      string
+	}{
+		{name: "missing file", path: filepath.Join(dir, "missing.json"), wantErr: "failed to replay"},
+		{name: "truncated JSON", path: truncated("build.json", 10), wantErr: "line 3"},
+		{name: "truncated binary", path: truncated("build.pb", 3), binaryFormat: true, wantErr: "event 2: unexpected EOF"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPlugin(t, newRecordingAgent())
+			p.dryRun = true
+			chdirTemp(t)
+			err := p.replay(tc.path, tc.binaryFormat)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("replay() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseReplayArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args       []string
+		wantPath   string
+		wantBinary bool
+		wantErr    bool
+	}{
+		{args: []string{"replay", "bep.json"}, wantPath: "bep.json"},
+		{args: []string{"replay", "--binary", "bep"}, wantPath: "bep", wantBinary: true},
+		{args: []string{"replay", "bep.pb"}, wantPath: "bep.pb", wantBinary: true},
+		{args: []string{"replay", "bep.bin"}, wantPath: "bep.bin", wantBinary: true},
+		{args: nil, wantErr: true},
+		{args: []string{"upload", "bep.json"}, wantErr: true},
+		{args: []string{"replay"}, wantErr: true},
+		{args: []string{"replay", "--binary"}, wantErr: true},
+		{args: []string{"replay", "a.json", "b.json"}, wantErr: true},
+	} {
+		path, binaryFormat, err := parseReplayArgs(tc.args)
+		if tc.wantErr {
+			if err == nil || !strings.HasPrefix(err.Error(), "usage:") {
+				t.Errorf("parseReplayArgs(%q) error = %v, want the usage", tc.args, err)
+			}
+			continue
+		}
+		if err != nil || path != tc.wantPath || binaryFormat != tc.wantBinary {
+			t.Errorf("parseReplayArgs(%q) = %q, %t, %v, want %q, %t", tc.args, path, binaryFormat, err, tc.wantPath, tc.wantBinary)
+		}
+	}
+}
@@ -8,8 +8,13 @@ import (
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type History struct {
@@ -20,14 +25,28 @@ type History struct {
 
 type AnalyticsTestPayload struct {
 	ID              string                `json:"id"`
+	Scope           string                `json:"scope,omitempty"`
 	Name            string                `json:"name"`
+	FileName        string                `json:"file_name,omitempty"`
 	History         History               `json:"history"`
 	Result          string                `json:"result"`
 	FailureReason   *string               `json:"failure_reason,omitempty"`
 	FailureExpanded []map[string][]string `json:"failure_expanded,omitempty"`
 }
 
-func PostResults(ctx context.Context, token string, results []*AnalyticsTestPayload) error {
+// DefaultAnalyticsURL is the base URL of the Buildkite Test Analytics API.
+const DefaultAnalyticsURL = "https://analytics-api.buildkite.com"
+
+// analyticsUploadURL returns the upload endpoint of the Test Analytics API served at baseURL.
+func analyticsUploadURL(baseURL string) string {
+	if baseURL == "" {
+		baseURL = DefaultAnalyticsURL
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/v1/uploads"
+}
+
+// PostResults uploads the test results to the Test Analytics API served at baseURL, by chunks.
+func PostResults(ctx context.Context, baseURL string, token string, results []*AnalyticsTestPayload) error {
 	if len(results) == 0 || token == "" {
 		return nil
 	}
@@ -53,7 +72,7 @@ func PostResults(ctx context.Context, token string, results []*AnalyticsTestPayl
 	}
 
 	for _, chunk := range chunks {
-		if err := postResults(ctx, token, chunk); err != nil {
+		if err := postResults(ctx, baseURL, token, chunk); err != nil {
 			return err
 		}
 	}
@@ -72,17 +91,120 @@ func addBuildkiteEnvFields(formWriter *multipart.Writer) {
 	formWriter.WriteField("run_env[message]", os.Getenv("BUILDKITE_MESSAGE"))
 }
 
-// postToAnalytics sends a POST request to the Buildkite Analytics API
-func postToAnalytics(ctx context.Context, token string, buf *bytes.Buffer, formWriter *multipart.Writer) error {
-	req, err := http.NewRequest("POST", "https://analytics-api.buildkite.com/v1/uploads", buf)
+const (
+	// analyticsMaxAttempts is how many times an upload is attempted before giving up.
+	analyticsMaxAttempts = 5
+	// analyticsBackoffBase is the delay before the first retry, doubled on each subsequent one.
+	analyticsBackoffBase = 1 * time.Second
+	// analyticsBackoffMax caps the delay between two attempts, including the one requested by the API.
+	analyticsBackoffMax = 60 * time.Second
+	// analyticsRequestTimeout is the timeout of a single upload request.
+	analyticsRequestTimeout = 60 * time.Second
+	// analyticsMaxErrorBody is how much of the response body is kept when an upload is rejected.
+	analyticsMaxErrorBody = 4 * 1024
+)
+
+// AnalyticsError is returned when the Buildkite Analytics API rejects an upload.
+type AnalyticsError struct {
+	StatusCode int
+	// Body is the beginning of the response body, which explains why the upload was rejected.
+	Body string
+
+	retryAfter time.Duration
+}
+
+func (e *AnalyticsError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("status code = %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status code = %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary returns true if the upload may succeed if retried later.
+func (e *AnalyticsError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// postToAnalytics sends a POST request to the Buildkite Analytics API served at baseURL, retrying with an
+// exponential backoff on network errors, server errors and when being rate limited.
+func postToAnalytics(ctx context.Context, baseURL string, token string, buf *bytes.Buffer, formWriter *multipart.Writer) error {
+	// Keep the body around, so it can be sent again when retrying.
+	body := buf.Bytes()
+	contentType := formWriter.FormDataContentType()
+
+	backoff := analyticsBackoffBase
+	var err error
+	for attempt := 1; attempt <= analyticsMaxAttempts; attempt++ {
+		err = postToAnalyticsOnce(ctx, analyticsUploadURL(baseURL), token, body, contentType)
+		if err == nil {
+			return nil
+		}
+
+		delay := backoff
+		var apiErr *AnalyticsError
+		if errors.As(err, &apiErr) {
+			if !apiErr.Temporary() {
+				return err
+			}
+			if apiErr.retryAfter > 0 {
+				delay = apiErr.retryAfter
+			}
+		} else if ctx.Err() != nil || !isNetworkError(err) {
+			// Either the network error is only the consequence of the context being done, or the request
+			// couldn't be made at all, e.g. because of a malformed URL, which retrying won't fix.
+			return err
+		}
+		if attempt == analyticsMaxAttempts {
+			break
+		}
+		if delay > analyticsBackoffMax {
+			delay = analyticsBackoffMax
+		}
+
+		if err := analyticsSleep(ctx, delay); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", analyticsMaxAttempts, err)
+}
+
+// analyticsSleep waits for d before an upload is retried, unless ctx is done first. Tests replace it to not wait.
+var analyticsSleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isNetworkError returns true if err is an HTTP request failing because of the network, e.g. a connection refused
+// or reset, or a request timing out, as opposed to a request that couldn't be sent at all.
+func isNetworkError(err error) bool {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(urlErr.Err, &netErr) || errors.Is(urlErr.Err, io.EOF) || errors.Is(urlErr.Err, io.ErrUnexpectedEOF)
+}
+
+func postToAnalyticsOnce(ctx context.Context, uploadURL string, token string, body []byte, contentType string) error {
+	ctx, cancel := context.WithTimeout(ctx, analyticsRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Authorization", fmt.Sprintf("Token token=\"%s\"", token))
-	req.Header.Set("Content-Type", formWriter.FormDataContentType())
+	req.Header.Set("Content-Type", contentType)
 
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -90,12 +212,30 @@ func postToAnalytics(ctx context.Context, token string, buf *bytes.Buffer, formW
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		return nil
-	} else {
-		return errors.New(fmt.Sprintf("status code = %d", resp.StatusCode))
 	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, analyticsMaxErrorBody))
+	return &AnalyticsError{
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(b)),
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or a date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
 }
 
-func postResults(ctx context.Context, token string, results []*AnalyticsTestPayload) error {
+func postResults(ctx context.Context, baseURL string, token string, results []*AnalyticsTestPayload) error {
 	var buf bytes.Buffer
 	formWriter := multipart.NewWriter(&buf)
 
@@ -118,7 +258,7 @@ func postResults(ctx context.Context, token string, results []*AnalyticsTestPayl
 		return err
 	}
 
-	return postToAnalytics(ctx, token, &buf, formWriter)
+	return postToAnalytics(ctx, baseURL, token, &buf, formWriter)
 }
 
 func SaveTestResults(res []*AnalyticsTestPayload) error {
@@ -130,8 +270,8 @@ func SaveTestResults(res []*AnalyticsTestPayload) error {
 	return json.NewEncoder(f).Encode(res)
 }
 
-// PostJUnitXML uploads a JUnit XML file to Buildkite Test Analytics
-func PostJUnitXML(ctx context.Context, token string, xmlFilePath string) error {
+// PostJUnitXML uploads a JUnit XML file to the Test Analytics API served at baseURL.
+func PostJUnitXML(ctx context.Context, baseURL string, token string, xmlFilePath string) error {
 	if token == "" {
 		return nil
 	}
@@ -161,5 +301,5 @@ func PostJUnitXML(ctx context.Context, token string, xmlFilePath string) error {
 		return err
 	}
 
-	return postToAnalytics(ctx, token, &buf, formWriter)
+	return postToAnalytics(ctx, baseURL, token, &buf, formWriter)
 }
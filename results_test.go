@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"aspect.build/cli/bazel/buildeventstream"
+)
+
+const testXML = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="server">
+    <testcase name="TestHealthCheck" classname="server" time="0.01"></testcase>
+    <testcase name="TestServeHTTP" classname="server" time="1,200.5">
+      <failure message="got status 500, want 200">server_test.go:42: GET /api/users</failure>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+
+// analyticsRequest is an upload received by the Test Analytics API served by newAnalyticsServer.
+type analyticsRequest struct {
+	path          string
+	authorization string
+	fields        map[string]string
+}
+
+// analyticsServer serves the Test Analytics API, recording the uploads it receives.
+type analyticsServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []analyticsRequest
+}
+
+// newAnalyticsServer returns a server replying to the nth upload it receives, starting at 1, with handle.
+func newAnalyticsServer(t *testing.T, handle func(w http.ResponseWriter, n int)) *analyticsServer {
+	s := &analyticsServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := analyticsRequest{
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+			fields:        map[string]string{},
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("failed to read multipart body: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("failed to read multipart body: %v", err)
+				break
+			}
+			b, _ := io.ReadAll(part)
+			req.fields[part.FormName()] = string(b)
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		n := len(s.requests)
+		s.mu.Unlock()
+		handle(w, n)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Requests returns the uploads received so far.
+func (s *analyticsServer) Requests() []analyticsRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]analyticsRequest(nil), s.requests...)
+}
+
+func TestPostResults(t *testing.T) {
+	t.Setenv("BUILDKITE_BUILD_ID", "build-1")
+	t.Setenv("BUILDKITE_COMMIT", "0123456789abcdef")
+	server := newAnalyticsServer(t, func(w http.ResponseWriter, n int) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	path := filepath.Join(t.TempDir(), "test.xml")
+	if err := os.WriteFile(path, []byte(testXML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr := &testResultInfo{
+		result: &buildeventstream.TestResult{Status: buildeventstream.TestStatus_FAILED},
+		label:  "//server:server_test",
+	}
+	payloads, err := tr.TestCasePayloads("app/", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A trailing slash in the base URL must not end up in the path.
+	if err := PostResults(context.Background(), server.URL+"/", "secret", payloads); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if req.path != "/v1/uploads" {
+		t.Errorf("path = %q, want /v1/uploads", req.path)
+	}
+	if want := `Token token="secret"`; req.authorization != want {
+		t.Errorf("Authorization = %q, want %q", req.authorization, want)
+	}
+	for field, want := range map[string]string{
+		"format":              "json",
+		"run_env[CI]":         "buildkite",
+		"run_env[key]":        "build-1",
+		"run_env[commit_sha]": "0123456789abcdef",
+	} {
+		if got := req.fields[field]; got != want {
+			t.Errorf("field %s = %q, want %q", field, got, want)
+		}
+	}
+
+	var data []*AnalyticsTestPayload
+	if err := json.Unmarshal([]byte(req.fields["data"]), &data); err != nil {
+		t.Fatalf("failed to decode data: %v", err)
+	}
+	if len(data) != 2 {
+		t.Fatalf("got %d test cases, want 2", len(data))
+	}
+	for i, want := range []struct {
+		name, result, reason string
+		duration             float64
+	}{
+		{"server.TestHealthCheck", "passed", "", 0.01},
+		{"server.TestServeHTTP", "failed", "got status 500, want 200", 1200.5},
+	} {
+		got := data[i]
+		if got.Scope != "app///server:server_test" || got.Name != want.name || got.Result != want.result {
+			t.Errorf("test case %d = %s %s %s, want app///server:server_test %s %s", i, got.Scope, got.Name, got.Result, want.name, want.result)
+		}
+		if reason := got.FailureReason; (reason == nil) != (want.reason == "") || reason != nil && *reason != want.reason {
+			t.Errorf("test case %d failure reason = %v, want %q", i, reason, want.reason)
+		}
+		if got.History.DurationInSec != want.duration {
+			t.Errorf("test case %d duration = %v, want %v", i, got.History.DurationInSec, want.duration)
+		}
+	}
+}
+
+func TestPostResultsRetries(t *testing.T) {
+	payloads := []*AnalyticsTestPayload{{ID: "1", Name: "//server:server_test", Result: "passed"}}
+	longBody := strings.Repeat("x", analyticsMaxErrorBody*2)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, tc := range []struct {
+		name    string
+		handle  func(w http.ResponseWriter, n int)
+		baseURL string
+		// wantRequests is the number of uploads the server gets, and wantDelays the waits between them.
+		wantRequests int
+		wantDelays   []time.Duration
+		// wantStatus is the status code of the AnalyticsError returned, 0 if none is.
+		wantStatus int
+		wantBody   string
+		wantErr    bool
+	}{
+		{
+			name: "rate limited",
+			handle: func(w http.ResponseWriter, n int) {
+				if n == 1 {
+					w.Header().Set("Retry-After", "7")
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+			},
+			wantRequests: 2,
+			wantDelays:   []time.Duration{7 * time.Second},
+		},
+		{
+			name: "server error then success",
+			handle: func(w http.ResponseWriter, n int) {
+				if n == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+			},
+			wantRequests: 2,
+			wantDelays:   []time.Duration{analyticsBackoffBase},
+		},
+		{
+			name: "server error persists",
+			handle: func(w http.ResponseWriter, n int) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantRequests: analyticsMaxAttempts,
+			wantDelays:   []time.Duration{analyticsBackoffBase, 2 * analyticsBackoffBase, 4 * analyticsBackoffBase, 8 * analyticsBackoffBase},
+			wantStatus:   http.StatusInternalServerError,
+			wantErr:      true,
+		},
+		{
+			name: "client error is not retried",
+			handle: func(w http.ResponseWriter, n int) {
+				http.Error(w, "invalid format", http.StatusBadRequest)
+			},
+			wantRequests: 1,
+			wantStatus:   http.StatusBadRequest,
+			wantBody:     "invalid format",
+			wantErr:      true,
+		},
+		{
+			name: "error body is truncated",
+			handle: func(w http.ResponseWriter, n int) {
+				http.Error(w, longBody, http.StatusUnprocessableEntity)
+			},
+			wantRequests: 1,
+			wantStatus:   http.StatusUnprocessableEntity,
+			wantBody:     longBody[:analyticsMaxErrorBody],
+			wantErr:      true,
+		},
+		{
+			name:       "connection refused is retried",
+			handle:     func(w http.ResponseWriter, n int) {},
+			baseURL:    closed.URL,
+			wantDelays: []time.Duration{analyticsBackoffBase, 2 * analyticsBackoffBase, 4 * analyticsBackoffBase, 8 * analyticsBackoffBase},
+			wantErr:    true,
+		},
+		{
+			name:    "malformed URL is not retried",
+			handle:  func(w http.ResponseWriter, n int) {},
+			baseURL: "ftp://analytics.example.com",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var delays []time.Duration
+			sleep := analyticsSleep
+			analyticsSleep = func(ctx context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				return nil
+			}
+			t.Cleanup(func() { analyticsSleep = sleep })
+
+			server := newAnalyticsServer(t, tc.handle)
+			baseURL := server.URL
+			if tc.baseURL != "" {
+				baseURL = tc.baseURL
+			}
+			err := PostResults(context.Background(), baseURL, "secret", payloads)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("PostResults() error = %v, want error: %t", err, tc.wantErr)
+			}
+			if n := len(server.Requests()); n != tc.wantRequests {
+				t.Errorf("server got %d requests, want %d", n, tc.wantRequests)
+			}
+			if fmt.Sprint(delays) != fmt.Sprint(tc.wantDelays) {
+				t.Errorf("waited %v between attempts, want %v", delays, tc.wantDelays)
+			}
+
+			var apiErr *AnalyticsError
+			if !errors.As(err, &apiErr) {
+				if tc.wantStatus != 0 {
+					t.Fatalf("PostResults() error = %v, want an *AnalyticsError", err)
+				}
+				return
+			}
+			if apiErr.StatusCode != tc.wantStatus {
+				t.Errorf("status code = %d, want %d", apiErr.StatusCode, tc.wantStatus)
+			}
+			if tc.wantBody != "" && apiErr.Body != tc.wantBody {
+				t.Errorf("body = %q (%d bytes), want %d bytes", apiErr.Body, len(apiErr.Body), len(tc.wantBody))
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// retryStepEnv is set in the environment of the generated retry step, so the plugin running in it doesn't
+	// upload yet another retry step when tests fail again.
+	retryStepEnv = "BAZEL_RETRY_STEP"
+
+	// defaultRetryCommand is the command of the retry step, unless configured otherwise.
+	defaultRetryCommand = "bazel test --flaky_test_attempts={{.FlakyTestAttempts}} {{.Targets}}"
+	// defaultRetryLabel is the label of the retry step in the Buildkite UI, unless configured otherwise.
+	defaultRetryLabel = ":repeat: Retry failed tests"
+	// defaultRetryFlakyTestAttempts is how many times the retried tests are attempted, unless configured otherwise.
+	defaultRetryFlakyTestAttempts = 3
+)
+
+// retryProperties configures the step retrying the failed test targets, uploaded to the pipeline when tests fail.
+type retryProperties struct {
+	// Enabled makes the plugin upload the retry step.
+	Enabled bool `yaml:"enabled"`
+	// Command is a Go text/template rendering the command of the step, see retryCommandData for the available
+	// fields. Defaults to defaultRetryCommand.
+	Command string `yaml:"command"`
+	// Label is the label of the step. Defaults to defaultRetryLabel.
+	Label string `yaml:"label"`
+	// Queue is the agent queue the step runs on. Defaults to the default queue of the pipeline.
+	Queue string `yaml:"queue"`
+	// FlakyTestAttempts is passed to the command template. Defaults to 3.
+	FlakyTestAttempts int `yaml:"flaky_test_attempts"`
+}
+
+// retryCommandData holds the values available to the retry command template.
+type retryCommandData struct {
+	// Labels are the labels of the failed test targets, in the order they were reported, with "$" escaped from
+	// the interpolation of pipeline upload.
+	Labels []string
+	// Targets are the labels shell-quoted and separated by spaces, to be used as arguments.
+	Targets string
+	// FlakyTestAttempts is the number of attempts configured for the retried tests.
+	FlakyTestAttempts int
+}
+
+// retryStep configures how the failed test targets are retried.
+type retryStep struct {
+	command           *template.Template
+	label             string
+	queue             string
+	flakyTestAttempts int
+}
+
+// newRetryStep returns the retry step configured by props, or nil if it's disabled.
+func newRetryStep(props retryProperties) (*retryStep, error) {
+	if !props.Enabled {
+		return nil, nil
+	}
+	text := props.Command
+	if text == "" {
+		text = defaultRetryCommand
+	}
+	tmpl, err := template.New("retry_command").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse retry command: %w", err)
+	}
+	r := &retryStep{
+		command:           tmpl,
+		label:             props.Label,
+		queue:             props.Queue,
+		flakyTestAttempts: props.FlakyTestAttempts,
+	}
+	if r.label == "" {
+		r.label = defaultRetryLabel
+	}
+	if r.flakyTestAttempts <= 0 {
+		r.flakyTestAttempts = defaultRetryFlakyTestAttempts
+	}
+	return r, nil
+}
+
+// pipelineStep is a command step of a Buildkite pipeline, see https://buildkite.com/docs/pipelines/command-step.
+type pipelineStep struct {
+	Label   string            `yaml:"label"`
+	Command string            `yaml:"command"`
+	Agents  map[string]string `yaml:"agents,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+}
+
+// pipeline renders the pipeline holding the step retrying the test targets with the given labels.
+func (r *retryStep) pipeline(labels []string) ([]byte, error) {
+	var command bytes.Buffer
+	data := retryCommandData{FlakyTestAttempts: r.flakyTestAttempts}
+	var targets []string
+	for _, label := range labels {
+		data.Labels = append(data.Labels, escapeInterpolation(label))
+		targets = append(targets, escapeInterpolation(shellQuote(label)))
+	}
+	data.Targets = strings.Join(targets, " ")
+	if err := r.command.Execute(&command, data); err != nil {
+		return nil, fmt.Errorf("failed to render retry command: %w", err)
+	}
+
+	step := pipelineStep{
+		Label:   r.label,
+		Command: strings.TrimSpace(command.String()),
+		Env:     map[string]string{retryStepEnv: "true"},
+	}
+	if r.queue != "" {
+		step.Agents = map[string]string{"queue": r.queue}
+	}
+	return yaml.Marshal(struct {
+		Steps []pipelineStep `yaml:"steps"`
+	}{Steps: []pipelineStep{step}})
+}
+
+// uploadRetryStep uploads a step to the pipeline, retrying only the test targets that failed, so a flaky test
+// doesn't cost rebuilding everything. Nothing is uploaded from a retry step itself, to not retry forever.
+func (p *BuildkitePlugin) uploadRetryStep(ctx context.Context) error {
+	if p.retryStep == nil {
+		return nil
+	}
+	if retrying, _ := strconv.ParseBool(os.Getenv(retryStepEnv)); retrying {
+		return nil
+	}
+	labels := p.failedTestLabels()
+	if len(labels) == 0 {
+		return nil
+	}
+	pipeline, err := p.retryStep.pipeline(labels)
+	if err != nil {
+		return err
+	}
+	if err := p.agent.PipelineUpload(ctx, pipeline); err != nil {
+		return fmt.Errorf("failed to upload retry step: %w", err)
+	}
+	return nil
+}
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes s for a POSIX shell, unless it only holds characters which don't need to be.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// escapeInterpolation escapes s from the environment variable interpolation done by buildkite-agent pipeline
+// upload, see https://buildkite.com/docs/agent/v3/cli-pipeline#environment-variable-substitution.
+func escapeInterpolation(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRetryStepNotUploadedFromRetryStep(t *testing.T) {
+	agent := newRecordingAgent()
+	p := newTestPlugin(t, agent)
+	t.Setenv(retryStepEnv, "true")
+	for _, event := range failedTestsBuild(t, func(t *testing.T, name string) string { return "" }) {
+		if err := p.BEPEventCallback(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.uploadRetryStep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if pipelines := agent.Pipelines(); len(pipelines) != 0 {
+		t.Errorf("uploaded %d pipelines from a retry step, want none:\n%s", len(pipelines), pipelines[0])
+	}
+}
+
+func TestRetryStepPipeline(t *testing.T) {
+	env := map[string]string{retryStepEnv: "true"}
+	for _, tc := range []struct {
+		name   string
+		props  retryProperties
+		labels []string
+		want   pipelineStep
+	}{
+		{
+			name:   "default",
+			props:  retryProperties{Enabled: true},
+			labels: []string{"//server:server_test", "//client:client_test"},
+			want: pipelineStep{
+				Label:   defaultRetryLabel,
+				Command: "bazel test --flaky_test_attempts=3 //server:server_test //client:client_test",
+				Env:     env,
+			},
+		},
+		{
+			name: "custom command and queue",
+			props: retryProperties{
+				Enabled:           true,
+				Command:           `{{range .Labels}}bazel test {{.}} --flaky_test_attempts={{$.FlakyTestAttempts}} --test_env=HOME=$HOME; {{end}}`,
+				Label:             "Retry",
+				Queue:             "bazel",
+				FlakyTestAttempts: 5,
+			},
+			labels: []string{"//server:server_test", "//client:client_test"},
+			want: pipelineStep{
+				Label:   "Retry",
+				Command: "bazel test //server:server_test --flaky_test_attempts=5 --test_env=HOME=$HOME; bazel test //client:client_test --flaky_test_attempts=5 --test_env=HOME=$HOME;",
+				Agents:  map[string]string{"queue": "bazel"},
+				Env:     env,
+			},
+		},
+		{
+			name:   "labels are quoted and escaped",
+			props:  retryProperties{Enabled: true},
+			labels: []string{"//server:server_test", "//data:it's $HOME"},
+			want: pipelineStep{
+				Label:   defaultRetryLabel,
+				Command: `bazel test --flaky_test_attempts=3 //server:server_test '//data:it'\''s $$HOME'`,
+				Env:     env,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newRetryStep(tc.props)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := r.pipeline(tc.labels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pipeline struct {
+				Steps []pipelineStep `yaml:"steps"`
+			}
+			if err := yaml.Unmarshal(b, &pipeline); err != nil {
+				t.Fatalf("failed to parse pipeline: %v\n%s", err, b)
+			}
+			if len(pipeline.Steps) != 1 || !reflect.DeepEqual(pipeline.Steps[0], tc.want) {
+				t.Errorf("pipeline() =\n%s\nwant the step %+v", b, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewRetryStep(t *testing.T) {
+	if r, err := newRetryStep(retryProperties{}); r != nil || err != nil {
+		t.Errorf("newRetryStep() of a disabled step = %v, %v, want nil", r, err)
+	}
+	if _, err := newRetryStep(retryProperties{Enabled: true, Command: "bazel test {{.Targets"}); err == nil {
+		t.Error("newRetryStep() with an invalid command template succeeded")
+	}
+}